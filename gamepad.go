@@ -0,0 +1,253 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"log"
+	"os"
+)
+
+//go:embed pads.json
+var padsJSON []byte
+
+// axisThreshold is how far a stick or trigger has to be pushed to press
+// the button bound to it.
+const axisThreshold = 0.5
+
+// padInput is a gamepad button, or a direction of an axis when isAxis is
+// set.
+type padInput struct {
+	button   glfw.GamepadButton
+	isAxis   bool
+	axis     glfw.GamepadAxis
+	positive bool
+}
+
+// padTarget is a controller button, or its turbo version.
+type padTarget struct {
+	button uint8
+	turbo  bool
+}
+
+// padLayout is what each NES button of a port is bound to on a gamepad.
+type padLayout map[padTarget][]padInput
+
+var padButtonNames = map[string]glfw.GamepadButton{
+	"A":           glfw.ButtonA,
+	"B":           glfw.ButtonB,
+	"X":           glfw.ButtonX,
+	"Y":           glfw.ButtonY,
+	"LeftBumper":  glfw.ButtonLeftBumper,
+	"RightBumper": glfw.ButtonRightBumper,
+	"Back":        glfw.ButtonBack,
+	"Start":       glfw.ButtonStart,
+	"Guide":       glfw.ButtonGuide,
+	"LeftThumb":   glfw.ButtonLeftThumb,
+	"RightThumb":  glfw.ButtonRightThumb,
+	"DpadUp":      glfw.ButtonDpadUp,
+	"DpadRight":   glfw.ButtonDpadRight,
+	"DpadDown":    glfw.ButtonDpadDown,
+	"DpadLeft":    glfw.ButtonDpadLeft,
+}
+
+// Axes are named with the direction that presses: "LeftX-" is the left
+// stick pushed left, "LeftY-" pushed up. Triggers rest at -1.
+var padAxisNames = map[string]glfw.GamepadAxis{
+	"LeftX":        glfw.AxisLeftX,
+	"LeftY":        glfw.AxisLeftY,
+	"RightX":       glfw.AxisRightX,
+	"RightY":       glfw.AxisRightY,
+	"LeftTrigger":  glfw.AxisLeftTrigger,
+	"RightTrigger": glfw.AxisRightTrigger,
+}
+
+func parsePadInput(name string) (padInput, bool) {
+	if button, ok := padButtonNames[name]; ok {
+		return padInput{button: button}, true
+	}
+	if n := len(name); n > 1 && (name[n-1] == '+' || name[n-1] == '-') {
+		if axis, ok := padAxisNames[name[:n-1]]; ok {
+			return padInput{isAxis: true, axis: axis, positive: name[n-1] == '+'}, true
+		}
+	}
+	return padInput{}, false
+}
+
+// loadPadLayouts reads the gamepad layouts in filename, or the built-in
+// ones (pads.json) when filename is empty. Like key bindings it's a JSON
+// list with one object per port, mapping button names to the gamepad
+// buttons and axis directions that press them:
+//
+//	[{"A": ["A"], "Up": ["DpadUp", "LeftY-"], ...}, ...]
+//
+// Gamepad inputs use the names of the SDL/GLFW standard layout. TurboA and
+// TurboB can be bound too, at the rate set in the key bindings.
+func loadPadLayouts(filename string) ([2]padLayout, error) {
+	layouts := [2]padLayout{{}, {}}
+	data := padsJSON
+	if filename != "" {
+		var err error
+		if data, err = os.ReadFile(filename); err != nil {
+			return layouts, err
+		}
+	}
+
+	var ports []map[string][]string
+	if err := json.Unmarshal(data, &ports); err != nil {
+		return layouts, fmt.Errorf("gamepad layout: %v", err)
+	}
+	if len(ports) > 2 {
+		return layouts, fmt.Errorf("gamepad layout: %d ports, the console has 2", len(ports))
+	}
+	for port, buttons := range ports {
+		for buttonName, inputNames := range buttons {
+			button, turbo, ok := parseButton(buttonName)
+			if !ok {
+				return layouts, fmt.Errorf("gamepad layout: port %d: unknown button %q", port+1, buttonName)
+			}
+			target := padTarget{button: button, turbo: turbo}
+			for _, inputName := range inputNames {
+				input, ok := parsePadInput(inputName)
+				if !ok {
+					return layouts, fmt.Errorf("gamepad layout: port %d: unknown input %q", port+1, inputName)
+				}
+				layouts[port][target] = append(layouts[port][target], input)
+			}
+		}
+	}
+	return layouts, nil
+}
+
+// loadPadMappings adds the SDL game controller mappings in filename
+// (gamecontrollerdb.txt) to the ones GLFW has built in, for pads it
+// doesn't know.
+func loadPadMappings(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !glfw.UpdateGamepadMappings(string(data)) {
+		return fmt.Errorf("%s: invalid gamepad mappings", filename)
+	}
+	return nil
+}
+
+// gamepads assigns connected gamepads to the two NES ports, in the order
+// they're plugged in, and reads them into button masks. Gamepads plugged
+// in while both ports are taken wait for one to be free.
+type gamepads struct {
+	layouts  [2]padLayout
+	attached [2]bool
+	joystick [2]glfw.Joystick
+	waiting  []glfw.Joystick
+	buttons  [2]uint8
+	turbo    [2]uint8
+}
+
+// scan attaches the gamepads already connected at start up.
+func (g *gamepads) scan() {
+	for joy := glfw.Joystick1; joy <= glfw.JoystickLast; joy++ {
+		if joy.Present() {
+			g.connect(joy)
+		}
+	}
+}
+
+func (g *gamepads) connect(joy glfw.Joystick) {
+	if !joy.IsGamepad() {
+		log.Printf("joystick %q has no gamepad mapping, see --pad-mappings", joy.GetName())
+		return
+	}
+	for port := range g.attached {
+		if !g.attached[port] {
+			g.attached[port] = true
+			g.joystick[port] = joy
+			log.Printf("gamepad %q on port %d", joy.GetGamepadName(), port+1)
+			return
+		}
+	}
+	g.waiting = append(g.waiting, joy)
+	log.Printf("gamepad %q waiting, both ports are taken", joy.GetGamepadName())
+}
+
+func (g *gamepads) disconnect(joy glfw.Joystick) {
+	for i, waiting := range g.waiting {
+		if waiting == joy {
+			g.waiting = append(g.waiting[:i], g.waiting[i+1:]...)
+			return
+		}
+	}
+	freed := false
+	for port := range g.attached {
+		if g.attached[port] && g.joystick[port] == joy {
+			freed = true
+			g.attached[port] = false
+			g.buttons[port] = 0
+			g.turbo[port] = 0
+			log.Printf("gamepad on port %d disconnected", port+1)
+		}
+	}
+	if !freed {
+		return
+	}
+	// The first gamepad waiting takes the free port
+	for len(g.waiting) > 0 {
+		next := g.waiting[0]
+		g.waiting = g.waiting[1:]
+		if next.Present() {
+			g.connect(next)
+			return
+		}
+	}
+}
+
+// joystickCallback handles hot-plugging, GLFW calls it from PollEvents.
+func (g *gamepads) joystickCallback(joy glfw.Joystick, event glfw.PeripheralEvent) {
+	switch event {
+	case glfw.Connected:
+		g.connect(joy)
+	case glfw.Disconnected:
+		g.disconnect(joy)
+	}
+}
+
+// poll reads the buttons held on every attached gamepad.
+func (g *gamepads) poll() {
+	for port := range g.attached {
+		g.buttons[port] = 0
+		g.turbo[port] = 0
+		if !g.attached[port] {
+			continue
+		}
+		state := g.joystick[port].GetGamepadState()
+		if state == nil {
+			continue
+		}
+		for target, inputs := range g.layouts[port] {
+			for _, input := range inputs {
+				if !input.pressed(state) {
+					continue
+				}
+				if target.turbo {
+					g.turbo[port] |= target.button
+				} else {
+					g.buttons[port] |= target.button
+				}
+				break
+			}
+		}
+	}
+}
+
+func (input padInput) pressed(state *glfw.GamepadState) bool {
+	if !input.isAxis {
+		return state.Buttons[input.button] == glfw.Press
+	}
+	value := state.Axes[input.axis]
+	if input.positive {
+		return value > axisThreshold
+	}
+	return value < -axisThreshold
+}
@@ -3,6 +3,7 @@ module nes-emu
 go 1.20
 
 require (
+	github.com/alexflint/go-arg v1.4.3
 	github.com/go-gl/gl v0.0.0-20211210172815-726fda9656d6
 	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20221017161538-93cebf72946b
 	github.com/gordonklaus/portaudio v0.0.0-20221027163845-7c3b689db3cc
@@ -11,7 +12,6 @@ require (
 )
 
 require (
-	github.com/alexflint/go-arg v1.4.3 // indirect
 	github.com/alexflint/go-scalar v1.1.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
@@ -0,0 +1,152 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/go-gl/glfw/v3.3/glfw"
+	"nes-emu/nes"
+	"os"
+)
+
+//go:embed keys.json
+var keysJSON []byte
+
+// binding is the controller button a key presses, or holds in turbo mode.
+type binding struct {
+	port   int
+	button uint8
+	turbo  bool
+}
+
+var buttonNames = map[string]uint8{
+	"A":      nes.ButtonA,
+	"B":      nes.ButtonB,
+	"Select": nes.ButtonSelect,
+	"Start":  nes.ButtonStart,
+	"Up":     nes.ButtonUp,
+	"Down":   nes.ButtonDown,
+	"Left":   nes.ButtonLeft,
+	"Right":  nes.ButtonRight,
+}
+
+var turboNames = map[string]uint8{
+	"TurboA": nes.ButtonA,
+	"TurboB": nes.ButtonB,
+}
+
+// parseButton understands both the buttons and their turbo versions.
+func parseButton(name string) (button uint8, turbo bool, ok bool) {
+	if button, ok := buttonNames[name]; ok {
+		return button, false, true
+	}
+	button, ok = turboNames[name]
+	return button, true, ok
+}
+
+// keyNames are the key names understood in binding files. Letters, digits,
+// function keys and the keypad digits are added by init.
+var keyNames = map[string]glfw.Key{
+	"Space":        glfw.KeySpace,
+	"Up":           glfw.KeyUp,
+	"Down":         glfw.KeyDown,
+	"Left":         glfw.KeyLeft,
+	"Right":        glfw.KeyRight,
+	"Enter":        glfw.KeyEnter,
+	"Tab":          glfw.KeyTab,
+	"Escape":       glfw.KeyEscape,
+	"LeftShift":    glfw.KeyLeftShift,
+	"RightShift":   glfw.KeyRightShift,
+	"LeftControl":  glfw.KeyLeftControl,
+	"RightControl": glfw.KeyRightControl,
+	"LeftAlt":      glfw.KeyLeftAlt,
+	"RightAlt":     glfw.KeyRightAlt,
+	"KPEnter":      glfw.KeyKPEnter,
+	"Comma":        glfw.KeyComma,
+	"Period":       glfw.KeyPeriod,
+	"Slash":        glfw.KeySlash,
+	"Semicolon":    glfw.KeySemicolon,
+	"Apostrophe":   glfw.KeyApostrophe,
+	"Minus":        glfw.KeyMinus,
+	"Equal":        glfw.KeyEqual,
+	"LeftBracket":  glfw.KeyLeftBracket,
+	"RightBracket": glfw.KeyRightBracket,
+	"Backslash":    glfw.KeyBackslash,
+	"GraveAccent":  glfw.KeyGraveAccent,
+	"Home":         glfw.KeyHome,
+	"End":          glfw.KeyEnd,
+	"PageUp":       glfw.KeyPageUp,
+	"PageDown":     glfw.KeyPageDown,
+	"Insert":       glfw.KeyInsert,
+	"Delete":       glfw.KeyDelete,
+}
+
+func init() {
+	// GLFW numbers these ranges contiguously
+	for i := 0; i < 26; i++ {
+		keyNames[string(rune('A'+i))] = glfw.KeyA + glfw.Key(i)
+	}
+	for i := 0; i < 10; i++ {
+		keyNames[fmt.Sprint(i)] = glfw.Key0 + glfw.Key(i)
+		keyNames[fmt.Sprintf("KP%d", i)] = glfw.KeyKP0 + glfw.Key(i)
+	}
+	for i := 0; i < 12; i++ {
+		keyNames[fmt.Sprintf("F%d", i+1)] = glfw.KeyF1 + glfw.Key(i)
+	}
+}
+
+// loadBindings reads the key bindings in filename, or the built-in ones
+// (keys.json) when filename is empty. The file is a JSON list with one
+// object per controller port, mapping button names to key names:
+//
+//	[{"A": "X", "B": "Z", "Start": "S", "TurboA": "V", ...}, {"A": "P", ...}]
+//
+// TurboA and TurboB are A and B pressed repeatedly, "TurboRate": n sets
+// how many frames they stay pressed and released on that port (0 keeps the
+// console's default). Buttons left out are not bound.
+func loadBindings(filename string) (map[glfw.Key]binding, [2]int, error) {
+	var turboRates [2]int
+	data := keysJSON
+	if filename != "" {
+		var err error
+		if data, err = os.ReadFile(filename); err != nil {
+			return nil, turboRates, err
+		}
+	}
+
+	var ports []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &ports); err != nil {
+		return nil, turboRates, fmt.Errorf("key bindings: %v", err)
+	}
+	if len(ports) > 2 {
+		return nil, turboRates, fmt.Errorf("key bindings: %d ports, the console has 2", len(ports))
+	}
+	bindings := make(map[glfw.Key]binding)
+	for port, buttons := range ports {
+		for buttonName, value := range buttons {
+			if buttonName == "TurboRate" {
+				if err := json.Unmarshal(value, &turboRates[port]); err != nil {
+					return nil, turboRates, fmt.Errorf("key bindings: port %d: TurboRate: %v", port+1, err)
+				}
+				continue
+			}
+			button, turbo, ok := parseButton(buttonName)
+			if !ok {
+				return nil, turboRates, fmt.Errorf("key bindings: port %d: unknown button %q", port+1, buttonName)
+			}
+			var keyName string
+			if err := json.Unmarshal(value, &keyName); err != nil {
+				return nil, turboRates, fmt.Errorf("key bindings: port %d: %s: %v", port+1, buttonName, err)
+			}
+			key, ok := keyNames[keyName]
+			if !ok {
+				return nil, turboRates, fmt.Errorf("key bindings: port %d: unknown key %q", port+1, keyName)
+			}
+			if _, dup := bindings[key]; dup {
+				return nil, turboRates, fmt.Errorf("key bindings: key %q is bound twice", keyName)
+			}
+			bindings[key] = binding{port: port, button: button, turbo: turbo}
+		}
+	}
+	return bindings, turboRates, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/alexflint/go-arg"
 	"github.com/go-gl/gl/all-core/gl"
@@ -9,19 +10,16 @@ import (
 	"github.com/nullboundary/glfont"
 	"image"
 	"log"
+	"nes-emu/nes"
+	"os"
+	"path/filepath"
 	"runtime"
-	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
 const padding = 0
 
-func numToHex(n int, d int) string {
-	format := "%0" + strconv.Itoa(d) + "x"
-	return fmt.Sprintf(format, n)
-}
-
 func createTexture() uint32 {
 	var texture uint32
 	gl.GenTextures(1, &texture)
@@ -74,48 +72,145 @@ func init() {
 	runtime.LockOSThread()
 }
 
-var controllerKeys = map[glfw.Key]uint8{
-	glfw.KeyX:     0x80,
-	glfw.KeyZ:     0x40,
-	glfw.KeyA:     0x20,
-	glfw.KeyS:     0x10,
-	glfw.KeyUp:    0x08,
-	glfw.KeyDown:  0x04,
-	glfw.KeyLeft:  0x02,
-	glfw.KeyRight: 0x01,
-}
-
 type Game struct {
 	window        *glfw.Window
 	screenTexture uint32
-	nes           *Bus
+	nes           *nes.Console
+	bindings      map[glfw.Key]binding
+	buttons       [2]uint8
+	turbo         [2]uint8
+	pads          gamepads
 	defaultFont   *glfont.Font
 	start         time.Time
-	lock          sync.Mutex
+
+	// Save states go next to the ROM, one file per slot
+	romPath   string
+	stateSlot int
+
+	// Holding backspace plays the history kept by rewind backwards
+	rewind     *nes.Rewind
+	rewinding  bool
+	rewindTick int
+
+	// movie is recorded or played back from moviePath, it's written back
+	// there on exit when it was recorded or rerecorded
+	movie          *nes.Movie
+	moviePath      string
+	movieRerecords int
+}
+
+// statePath is the file of the selected save state slot, game.ss0 to
+// game.ss9 for game.nes.
+func (g *Game) statePath() string {
+	return fmt.Sprintf("%s.ss%d", strings.TrimSuffix(g.romPath, filepath.Ext(g.romPath)), g.stateSlot)
+}
+
+// saveState writes the slot through a temporary file, so a failed save
+// doesn't destroy the previous one.
+func (g *Game) saveState() error {
+	path := g.statePath()
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = g.nes.SaveState(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (g *Game) loadState() error {
+	file, err := os.Open(g.statePath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return g.nes.LoadState(bufio.NewReader(file))
 }
 
 func (g *Game) keyboardCallback(window *glfw.Window, key glfw.Key, scancode int,
 	action glfw.Action, mods glfw.ModifierKey) {
+	// Controller bindings take precedence over the hotkeys
+	if b, ok := g.bindings[key]; ok {
+		held := &g.buttons[b.port]
+		if b.turbo {
+			held = &g.turbo[b.port]
+		}
+		switch action {
+		case glfw.Press:
+			*held |= b.button
+		case glfw.Release:
+			*held &^= b.button
+		}
+		g.updateButtons(b.port)
+		return
+	}
+
 	switch action {
 	case glfw.Release:
-		value, ok := controllerKeys[key]
-		if ok {
-			g.nes.controller[0] &= ^value
+		if key == glfw.KeyBackspace {
+			g.rewinding = false
 		}
 	case glfw.Press:
-		value, ok := controllerKeys[key]
-		if ok {
-			g.nes.controller[0] |= value
-		}
-		if key == glfw.KeyR {
-			g.nes.reset()
+		switch {
+		case key == glfw.KeyR:
+			g.nes.Reset()
+		case key == glfw.KeyF6 && g.movie != nil:
+			g.nes.SetMovieReadOnly(!g.nes.MovieReadOnly())
+			log.Printf("movie read-only: %t", g.nes.MovieReadOnly())
+		case key == glfw.KeyBackspace && g.rewind != nil:
+			g.rewinding = true
+			g.rewindTick = 0
+		case key >= glfw.Key0 && key <= glfw.Key9:
+			g.stateSlot = int(key - glfw.Key0)
+			log.Printf("save state slot %d", g.stateSlot)
+		case key == glfw.KeyF5:
+			if err := g.saveState(); err != nil {
+				log.Printf("save state: %v", err)
+			} else {
+				log.Printf("saved state %d", g.stateSlot)
+			}
+		case key == glfw.KeyF9:
+			if err := g.loadState(); err != nil {
+				log.Printf("load state: %v", err)
+			} else {
+				log.Printf("loaded state %d", g.stateSlot)
+			}
 		}
 	}
 }
 
-func NewGame(nes *Bus, lock sync.Mutex) *Game {
+// saveMovie writes the movie back to its file, if it was recorded or
+// changed by loading states in read-write mode.
+func (g *Game) saveMovie(recorded bool) {
+	if !recorded && g.movie.RerecordCount == g.movieRerecords {
+		return
+	}
+	if err := writeMovie(g.moviePath, g.movie); err != nil {
+		log.Printf("save movie: %v", err)
+	}
+}
+
+// updateButtons gives the console what's held on a port, from the keyboard
+// and from the gamepad.
+func (g *Game) updateButtons(port int) {
+	g.nes.SetButtons(port, g.buttons[port]|g.pads.buttons[port])
+	g.nes.SetTurbo(port, g.turbo[port]|g.pads.turbo[port])
+}
+
+func NewGame(console *nes.Console, romPath string, bindings map[glfw.Key]binding, layouts [2]padLayout) *Game {
 	// initialize glfw
-	game := &Game{nes: nes, lock: lock}
+	game := &Game{nes: console, romPath: romPath, bindings: bindings}
+	game.pads.layouts = layouts
 
 	// create window
 	glfw.WindowHint(glfw.ContextVersionMajor, 2)
@@ -128,6 +223,8 @@ func NewGame(nes *Bus, lock sync.Mutex) *Game {
 	game.window.MakeContextCurrent()
 	glfw.SwapInterval(1)
 	game.window.SetKeyCallback(game.keyboardCallback)
+	glfw.SetJoystickCallback(game.pads.joystickCallback)
+	game.pads.scan()
 
 	// initialize gl
 	if err := gl.Init(); err != nil {
@@ -138,52 +235,186 @@ func NewGame(nes *Bus, lock sync.Mutex) *Game {
 	gl.Disable(gl.LIGHTING)
 
 	game.screenTexture = createTexture()
+	// The FPS overlay is optional, the emulator runs fine without the font
 	game.defaultFont, err = glfont.LoadFont("Minecraft.ttf", int32(52), 1920, 1080)
 	if err != nil {
-		log.Panicf("LoadFont: %v", err)
+		log.Printf("LoadFont: %v", err)
+		game.defaultFont = nil
+	} else {
+		game.defaultFont.SetColor(1.0, 1.0, 1.0, 1.0)
 	}
 	return game
 }
 
+// RunFrame advances the game by one frame. While rewinding it goes back
+// one snapshot every rewind interval instead, so the history plays back
+// at normal speed, and runs a frame from it to show its picture.
+func (g *Game) RunFrame() error {
+	if !g.rewinding {
+		err := g.nes.StepFrame()
+		if g.rewind != nil {
+			if recordErr := g.rewind.Record(); err == nil {
+				err = recordErr
+			}
+		}
+		return err
+	}
+	tick := g.rewindTick
+	g.rewindTick++
+	if tick%g.rewind.Interval() != 0 {
+		return nil
+	}
+	if _, err := g.rewind.Step(); err != nil {
+		return err
+	}
+	return g.nes.StepFrame()
+}
+
+// Vsync sets the pace: each Draw runs exactly one frame, and rate control
+// bends the sample rate by up to 0.5% to keep the audio buffer about half
+// full, which absorbs a display between 59.8 and 60.4 Hz with no visible
+// judder. Frames are only dropped or doubled when the buffer leaves the
+// wide band between audioLowFill and audioHighFill, which a display far
+// from 60 Hz does, or a slow one; then catching up stops at the middle of
+// the band or after maxFramesPerDraw frames. The band is wide enough that
+// the buffer's wobble as the audio device reads it in chunks stays inside.
+const (
+	audioLowFill     = 0.15
+	audioMidFill     = 0.5
+	audioHighFill    = 0.85
+	maxFramesPerDraw = 4
+)
+
+// RunFrames runs the frames for the next Draw: normally one, none when the
+// audio buffer is too full, or several when it's running dry. Rewinding
+// ignores the audio and steps once per Draw.
+func (g *Game) RunFrames() error {
+	audio := g.nes.AudioBuffer()
+	if g.rewinding || audio == nil {
+		return g.RunFrame()
+	}
+	fill := audio.Fill()
+	if fill > audioHighFill {
+		return nil
+	}
+	err := g.RunFrame()
+	if fill >= audioLowFill {
+		return err
+	}
+	for frames := 1; frames < maxFramesPerDraw && audio.Fill() < audioMidFill; frames++ {
+		if frameErr := g.RunFrame(); frameErr != nil {
+			err = frameErr
+		}
+	}
+	return err
+}
+
 func (g *Game) Draw() {
 	frameDuration := time.Now().Sub(g.start)
 	gl.BindTexture(gl.TEXTURE_2D, g.screenTexture)
-	g.lock.Lock()
-	setTexture(g.nes.ppu.screenImage)
-	g.lock.Unlock()
+	setTexture(g.nes.FrameBuffer())
 	drawBuffer(g.window)
-	gl.BindTexture(gl.TEXTURE_2D, 0)                                                   //r,g,b,a font color
-	g.defaultFont.Printf(0, 100, 1.0, "FPS: %f", 1.0/float64(frameDuration.Seconds())) //x,y,scale,string,printf args
+	gl.BindTexture(gl.TEXTURE_2D, 0)
+	if g.defaultFont != nil {
+		g.defaultFont.Printf(0, 100, 1.0, "FPS: %f", 1.0/float64(frameDuration.Seconds())) //x,y,scale,string,printf args
+	}
 	// Do OpenGL stuff.
 	g.window.SwapBuffers()
 	glfw.PollEvents()
+	g.pads.poll()
+	for port := range g.buttons {
+		g.updateButtons(port)
+	}
 	g.start = time.Now()
 }
 
 var args struct {
-	Rom string
+	Rom     string
+	Palette string `help:"palette file (.json or .pal) to use instead of the built-in one"`
+	Trace   string `help:"write a nestest-style log of every CPU instruction to this file"`
+	Keys    string `help:"key bindings file for both controllers, see keys.json"`
+
+	Pads        string `help:"gamepad layout file for both controllers, see pads.json"`
+	PadMappings string `help:"SDL gamecontrollerdb.txt with mappings for gamepads GLFW doesn't know"`
+
+	RewindMemory   int `help:"memory for the rewind history, in MB (0 disables rewinding)" default:"32"`
+	RewindInterval int `help:"frames between rewind snapshots" default:"2"`
+
+	Record string `help:"record the input from power on into this FCEUX .fm2 movie"`
+	Play   string `help:"play this FCEUX .fm2 movie back, read-only until F6 is pressed"`
 }
 
 func main() {
-	arg.MustParse(&args)
-	var mu sync.Mutex
-	cart := NewCartridge(args.Rom)
-	cpu := NewCPU()
-	ppu := NewPPU(mu)
-	apu := NewAPU()
-	nes := NewBus(cpu, ppu, apu)
-	cpu.connectBus(nes)
-	nes.insertCartridge(cart)
-	nes.reset()
-
-	err := glfw.Init()
+	p := arg.MustParse(&args)
+	if args.Record != "" && args.Play != "" {
+		p.Fail("--record and --play can't be used together")
+	}
+	bindings, turboRates, err := loadBindings(args.Keys)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	layouts, err := loadPadLayouts(args.Pads)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	console := nes.NewConsole()
+	if err := console.LoadROM(args.Rom); err != nil {
+		log.Fatalln(err)
+	}
+	for port, rate := range turboRates {
+		if rate != 0 {
+			console.SetTurboRate(port, rate)
+		}
+	}
+	if args.Palette != "" {
+		if err := console.SetPalette(args.Palette); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	defer func() {
+		if err := console.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if args.Trace != "" {
+		file, err := os.Create(args.Trace)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		trace := bufio.NewWriter(file)
+		console.SetTrace(trace)
+		defer func() {
+			if err := trace.Flush(); err != nil {
+				log.Println(err)
+			}
+			file.Close()
+		}()
+	}
+
+	err = glfw.Init()
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer glfw.Terminate()
-	game := NewGame(nes, mu)
+	if args.PadMappings != "" {
+		if err := loadPadMappings(args.PadMappings); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	game := NewGame(console, args.Rom, bindings, layouts)
+	if args.RewindMemory > 0 {
+		game.rewind = nes.NewRewind(console, args.RewindInterval, args.RewindMemory<<20)
+	}
+	if args.Record != "" || args.Play != "" {
+		game.moviePath = args.Record + args.Play
+		game.movie, err = startMovie(console, args.Rom, args.Record, args.Play)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		game.movieRerecords = game.movie.RerecordCount
+		defer game.saveMovie(args.Record != "")
+	}
 	game.start = time.Now()
-	game.defaultFont.SetColor(1.0, 1.0, 1.0, 1.0)
 
 	portaudio.Initialize()
 	defer portaudio.Terminate()
@@ -192,28 +423,12 @@ func main() {
 		panic(err)
 	}
 	//parameters := portaudio.HighLatencyParameters(nil, host.DefaultOutputDevice)
-	//start := time.Now()
+	console.SetSampleFrequency(uint32(44100))
+	console.SetRateControl(true)
+	audio := console.AudioBuffer()
 	callback := func(out []float32) {
-		//dur := time.Now().Sub(start)
-		//fmt.Printf("Audio FPS %s\n", dur)
-		//
-		//start = time.Now()
-
-		output := float32(0)
-
-		for i := range out {
-			if i%1 == 0 {
-				select {
-				case sample := <-nes.AudioSample:
-					output = sample
-				default:
-					output = 0
-				}
-			}
-			out[i] = output
-		}
+		audio.Read(out)
 	}
-	nes.SetSampleFrequency(uint32(44100))
 	stream, err := portaudio.OpenDefaultStream(0, 1, 44100, 0, callback)
 
 	if err != nil {
@@ -223,16 +438,17 @@ func main() {
 		panic(err)
 	}
 
+	var lastErr error
 	for !game.window.ShouldClose() {
 		gl.Clear(gl.COLOR_BUFFER_BIT)
 
-		for true {
-			nes.clock()
-			if nes.ppu.frameComplete {
-				break
-			}
+		// A jammed CPU keeps the picture on screen until reset, report it
+		// once rather than every frame
+		err := game.RunFrames()
+		if err != nil && lastErr == nil {
+			log.Println(err)
 		}
-		nes.ppu.frameComplete = false
+		lastErr = err
 		game.Draw()
 	}
 	stream.Close()
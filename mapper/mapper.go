@@ -1,5 +1,7 @@
 package mapper
 
+import "io"
+
 type MIRROR uint8
 
 const (
@@ -15,9 +17,23 @@ type Mapper interface {
 	CpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool
 	PpuMapRead(addr uint16, mappedAddr *uint32) bool
 	PpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool
+	PrgRamMapRead(addr uint16, mappedAddr *uint32) bool
+	PrgRamMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool
 	Reset()
 	Mirror() MIRROR
-	irqState() bool
-	irqClear()
-	scanline()
+	IrqState() bool
+	IrqClear()
+	Scanline()
+
+	// SaveState writes the registers and any other state that isn't
+	// cartridge memory, LoadState restores it. Save states rely on them to
+	// round-trip exactly.
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+}
+
+// CpuClocker is implemented by mappers that follow the CPU clock itself.
+// CpuClock is called at the end of every CPU cycle, DMA cycles included.
+type CpuClocker interface {
+	CpuClock()
 }
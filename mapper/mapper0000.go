@@ -1,10 +1,21 @@
 package mapper
 
+import "io"
+
 type Mapper0000 struct {
 	PrgBanks uint8
 	ChrBanks uint8
 }
 
+func init() {
+	Register(0, 0, func(board Board) Mapper {
+		return &Mapper0000{
+			PrgBanks: board.PrgBanks,
+			ChrBanks: board.ChrBanks,
+		}
+	})
+}
+
 func (m Mapper0000) CpuMapRead(addr uint16, mappedAddr *uint32) bool {
 	if addr >= 0x8000 && addr <= 0xFFFF {
 		base := uint16(0x3FFF)
@@ -47,6 +58,22 @@ func (m Mapper0000) PpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) boo
 	return false
 }
 
+func (m Mapper0000) PrgRamMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF {
+		*mappedAddr = uint32(addr & 0x1FFF)
+		return true
+	}
+	return false
+}
+
+func (m Mapper0000) PrgRamMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF {
+		*mappedAddr = uint32(addr & 0x1FFF)
+		return true
+	}
+	return false
+}
+
 func (m Mapper0000) Reset() {
 
 }
@@ -54,10 +81,18 @@ func (m Mapper0000) Reset() {
 func (m Mapper0000) Mirror() MIRROR {
 	return HARDWARE
 }
-func (m Mapper0000) irqState() bool {
+func (m Mapper0000) IrqState() bool {
 	return false
 }
-func (m Mapper0000) irqClear() {
+func (m Mapper0000) IrqClear() {
+}
+func (m Mapper0000) Scanline() {
+}
+
+// NROM has no registers.
+func (m Mapper0000) SaveState(w io.Writer) error {
+	return nil
 }
-func (m Mapper0000) scanline() {
+func (m Mapper0000) LoadState(r io.Reader) error {
+	return nil
 }
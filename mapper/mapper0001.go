@@ -0,0 +1,254 @@
+package mapper
+
+import "io"
+
+// Mapper0001 is the MMC1 and the SxROM boards built around it. Registers
+// are loaded serially, one bit per write, through a 5 bit shift register.
+//
+// The CHR bank registers double as extra address lines on some boards:
+// SNROM uses bit 4 to disable PRG-RAM, SOROM bit 3 and SXROM bits 2-3 to
+// bank PRG-RAM, and SUROM/SXROM bit 4 to select a 256KB half of PRG ROM.
+type Mapper0001 struct {
+	PrgBanks   uint8
+	ChrBanks   uint8
+	PrgRamSize uint32
+	Submapper  uint8
+
+	shiftRegister uint8
+	shiftCount    uint8
+	control       uint8
+	chrBank0      uint8
+	chrBank1      uint8
+	prgBank       uint8
+	chrA12        bool
+
+	// The serial port ignores a write on the cycle after another one, like
+	// the second write of a read-modify-write instruction
+	written       bool
+	writtenBefore bool
+}
+
+func init() {
+	Register(1, 0, func(board Board) Mapper {
+		return &Mapper0001{
+			PrgBanks:   board.PrgBanks,
+			ChrBanks:   board.ChrBanks,
+			PrgRamSize: board.PrgRamSize + board.PrgNvramSize,
+			Submapper:  board.Submapper,
+		}
+	})
+}
+
+// chrSelect returns the CHR register that currently drives the extra
+// address lines. In 4KB mode it follows PPU A12, like on the real board.
+func (m *Mapper0001) chrSelect() uint8 {
+	if m.control&0x10 != 0 && m.chrA12 {
+		return m.chrBank1
+	}
+	return m.chrBank0
+}
+
+func (m *Mapper0001) prgRamBanks() uint8 {
+	switch {
+	case m.Submapper == 4 || m.PrgRamSize >= 0x8000:
+		return 4
+	case m.Submapper == 2 || m.PrgRamSize >= 0x4000:
+		return 2
+	}
+	return 1
+}
+
+func (m *Mapper0001) prgRamEnabled() bool {
+	if m.prgBank&0x10 != 0 {
+		return false
+	}
+	// SNROM: CHR RAM only, so bit 4 of the CHR register is free to act as
+	// a second PRG-RAM chip enable
+	if m.ChrBanks == 0 && m.PrgBanks <= 16 && m.prgRamBanks() == 1 && m.chrSelect()&0x10 != 0 {
+		return false
+	}
+	return true
+}
+
+func (m *Mapper0001) prgRamOffset() uint32 {
+	switch m.prgRamBanks() {
+	case 4:
+		return uint32((m.chrSelect()>>2)&0x03) * 0x2000
+	case 2:
+		return uint32((m.chrSelect()>>3)&0x01) * 0x2000
+	}
+	return 0
+}
+
+func (m *Mapper0001) CpuMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr < 0x8000 {
+		return false
+	}
+
+	// SEROM/SHROM/SH1ROM have a single fixed 32KB bank
+	if m.Submapper == 5 {
+		*mappedAddr = uint32(addr&0x7FFF) % (uint32(m.PrgBanks) * 0x4000)
+		return true
+	}
+
+	outer := uint8(0)
+	if m.PrgBanks > 16 {
+		outer = m.chrSelect() & 0x10
+	}
+
+	bank := uint8(0)
+	switch (m.control >> 2) & 0x03 {
+	case 0, 1:
+		bank = outer | (m.prgBank & 0x0E)
+		if addr >= 0xC000 {
+			bank |= 0x01
+		}
+	case 2:
+		if addr < 0xC000 {
+			bank = outer
+		} else {
+			bank = outer | (m.prgBank & 0x0F)
+		}
+	case 3:
+		if addr < 0xC000 {
+			bank = outer | (m.prgBank & 0x0F)
+		} else {
+			bank = outer | 0x0F
+		}
+	}
+	*mappedAddr = uint32(bank%m.PrgBanks)*0x4000 + uint32(addr&0x3FFF)
+	return true
+}
+
+func (m *Mapper0001) CpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr < 0x8000 {
+		return false
+	}
+
+	ignored := m.writtenBefore
+	m.written = true
+	if ignored {
+		return false
+	}
+
+	if data&0x80 != 0 {
+		m.shiftRegister = 0
+		m.shiftCount = 0
+		m.control |= 0x0C
+		return false
+	}
+
+	m.shiftRegister |= (data & 0x01) << m.shiftCount
+	m.shiftCount++
+	if m.shiftCount < 5 {
+		return false
+	}
+
+	switch (addr >> 13) & 0x03 {
+	case 0:
+		m.control = m.shiftRegister
+	case 1:
+		m.chrBank0 = m.shiftRegister
+	case 2:
+		m.chrBank1 = m.shiftRegister
+	case 3:
+		m.prgBank = m.shiftRegister
+	}
+	m.shiftRegister = 0
+	m.shiftCount = 0
+	return false
+}
+
+func (m *Mapper0001) CpuClock() {
+	m.writtenBefore = m.written
+	m.written = false
+}
+
+func (m *Mapper0001) chrMap(addr uint16) uint32 {
+	chrBanks4k := uint32(m.ChrBanks) * 2
+	if chrBanks4k == 0 {
+		chrBanks4k = 2
+	}
+
+	bank := uint32(0)
+	if m.control&0x10 == 0 {
+		bank = uint32(m.chrBank0&0x1E) | uint32(addr>>12)
+	} else if addr < 0x1000 {
+		bank = uint32(m.chrBank0)
+	} else {
+		bank = uint32(m.chrBank1)
+	}
+	return (bank%chrBanks4k)*0x1000 + uint32(addr&0x0FFF)
+}
+
+func (m *Mapper0001) PpuMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr < 0x2000 {
+		m.chrA12 = addr&0x1000 != 0
+		*mappedAddr = m.chrMap(addr)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0001) PpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr < 0x2000 && m.ChrBanks == 0 {
+		*mappedAddr = m.chrMap(addr)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0001) PrgRamMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF && m.prgRamEnabled() {
+		*mappedAddr = m.prgRamOffset() + uint32(addr&0x1FFF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0001) PrgRamMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF && m.prgRamEnabled() {
+		*mappedAddr = m.prgRamOffset() + uint32(addr&0x1FFF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0001) Reset() {
+	m.shiftRegister = 0
+	m.shiftCount = 0
+	m.control = 0x0C
+	m.chrBank0 = 0
+	m.chrBank1 = 0
+	m.prgBank = 0
+}
+
+func (m *Mapper0001) Mirror() MIRROR {
+	switch m.control & 0x03 {
+	case 0:
+		return ONESCREEN_LO
+	case 1:
+		return ONESCREEN_HI
+	case 2:
+		return VERTICAL
+	}
+	return HORIZONTAL
+}
+func (m *Mapper0001) IrqState() bool {
+	return false
+}
+func (m *Mapper0001) IrqClear() {
+}
+func (m *Mapper0001) Scanline() {
+}
+
+// state lists the registers SaveState and LoadState cover, in order.
+func (m *Mapper0001) state() []interface{} {
+	return []interface{}{&m.shiftRegister, &m.shiftCount, &m.control, &m.chrBank0, &m.chrBank1, &m.prgBank, &m.chrA12, &m.written, &m.writtenBefore}
+}
+func (m *Mapper0001) SaveState(w io.Writer) error {
+	return writeState(w, m.state())
+}
+func (m *Mapper0001) LoadState(r io.Reader) error {
+	return readState(r, m.state())
+}
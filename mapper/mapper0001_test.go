@@ -0,0 +1,72 @@
+package mapper
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func writeSerial(m Mapper, addr uint16, value uint8) {
+	mappedAddr := uint32(0)
+	for i := 0; i < 5; i++ {
+		m.CpuMapWrite(addr, &mappedAddr, (value>>i)&0x01)
+	}
+}
+
+func TestMapper0001Banking(t *testing.T) {
+	m := &Mapper0001{PrgBanks: 8, ChrBanks: 4}
+	m.Reset()
+	mappedAddr := uint32(0)
+
+	// Power-on: last bank fixed at $C000
+	m.CpuMapRead(0xC000, &mappedAddr)
+	assert.Equal(t, uint32(7*0x4000), mappedAddr)
+
+	writeSerial(m, 0xE000, 0x03)
+	m.CpuMapRead(0x8123, &mappedAddr)
+	assert.Equal(t, uint32(3*0x4000+0x123), mappedAddr)
+
+	// 32KB mode ignores the low bit of the bank number
+	writeSerial(m, 0x8000, 0x02)
+	assert.Equal(t, VERTICAL, m.Mirror())
+	m.CpuMapRead(0xC000, &mappedAddr)
+	assert.Equal(t, uint32(3*0x4000), mappedAddr)
+
+	// 4KB CHR mode
+	writeSerial(m, 0x8000, 0x10)
+	assert.Equal(t, ONESCREEN_LO, m.Mirror())
+	writeSerial(m, 0xA000, 0x05)
+	writeSerial(m, 0xC000, 0x02)
+	m.PpuMapRead(0x0010, &mappedAddr)
+	assert.Equal(t, uint32(5*0x1000+0x10), mappedAddr)
+	m.PpuMapRead(0x1010, &mappedAddr)
+	assert.Equal(t, uint32(2*0x1000+0x10), mappedAddr)
+
+	// A write with bit 7 set resets the shift register and PRG mode
+	m.CpuMapWrite(0x8000, &mappedAddr, 0x01)
+	m.CpuMapWrite(0x8000, &mappedAddr, 0x80)
+	m.CpuMapRead(0xC000, &mappedAddr)
+	assert.Equal(t, uint32(7*0x4000), mappedAddr)
+}
+
+func TestMapper0001PrgRam(t *testing.T) {
+	// SXROM: 512KB PRG, 32KB PRG-RAM
+	m := &Mapper0001{PrgBanks: 32, ChrBanks: 0, PrgRamSize: 0x8000}
+	m.Reset()
+	mappedAddr := uint32(0)
+
+	writeSerial(m, 0xA000, 0x1C)
+	assert.True(t, m.PrgRamMapRead(0x6010, &mappedAddr))
+	assert.Equal(t, uint32(3*0x2000+0x10), mappedAddr)
+	m.CpuMapRead(0xC000, &mappedAddr)
+	assert.Equal(t, uint32(31*0x4000), mappedAddr)
+
+	writeSerial(m, 0xE000, 0x10)
+	assert.False(t, m.PrgRamMapRead(0x6010, &mappedAddr))
+
+	// SNROM: bit 4 of the CHR register disables PRG-RAM
+	m = &Mapper0001{PrgBanks: 16, ChrBanks: 0, PrgRamSize: 0x2000}
+	m.Reset()
+	assert.True(t, m.PrgRamMapWrite(0x7FFF, &mappedAddr, 0))
+	writeSerial(m, 0xA000, 0x10)
+	assert.False(t, m.PrgRamMapWrite(0x7FFF, &mappedAddr, 0))
+}
@@ -1,5 +1,7 @@
 package mapper
 
+import "io"
+
 type Mapper0002 struct {
 	PrgBankSelectLo uint8
 	PrgBankSelectHi uint8
@@ -7,6 +9,15 @@ type Mapper0002 struct {
 	ChrBanks        uint8
 }
 
+func init() {
+	Register(2, 0, func(board Board) Mapper {
+		return &Mapper0002{
+			PrgBanks: board.PrgBanks,
+			ChrBanks: board.ChrBanks,
+		}
+	})
+}
+
 func (m *Mapper0002) CpuMapRead(addr uint16, mappedAddr *uint32) bool {
 	if addr >= 0x8000 && addr <= 0xBFFF {
 		*mappedAddr = uint32(m.PrgBankSelectLo)*0x4000 + uint32(addr&0x3FFF)
@@ -47,6 +58,22 @@ func (m *Mapper0002) PpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bo
 	return false
 }
 
+func (m *Mapper0002) PrgRamMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF {
+		*mappedAddr = uint32(addr & 0x1FFF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0002) PrgRamMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF {
+		*mappedAddr = uint32(addr & 0x1FFF)
+		return true
+	}
+	return false
+}
+
 func (m *Mapper0002) Reset() {
 	m.PrgBankSelectLo = 0
 	m.PrgBankSelectHi = m.PrgBanks - 1
@@ -55,10 +82,21 @@ func (m *Mapper0002) Reset() {
 func (m *Mapper0002) Mirror() MIRROR {
 	return HARDWARE
 }
-func (m *Mapper0002) irqState() bool {
+func (m *Mapper0002) IrqState() bool {
 	return false
 }
-func (m *Mapper0002) irqClear() {
+func (m *Mapper0002) IrqClear() {
+}
+func (m *Mapper0002) Scanline() {
+}
+
+// state lists the registers SaveState and LoadState cover, in order.
+func (m *Mapper0002) state() []interface{} {
+	return []interface{}{&m.PrgBankSelectLo, &m.PrgBankSelectHi}
+}
+func (m *Mapper0002) SaveState(w io.Writer) error {
+	return writeState(w, m.state())
 }
-func (m *Mapper0002) scanline() {
+func (m *Mapper0002) LoadState(r io.Reader) error {
+	return readState(r, m.state())
 }
@@ -1,11 +1,22 @@
 package mapper
 
+import "io"
+
 type Mapper0003 struct {
 	PrgBanks       uint8
 	ChrBanks       uint8
 	chrBanksSelect uint8
 }
 
+func init() {
+	Register(3, 0, func(board Board) Mapper {
+		return &Mapper0003{
+			PrgBanks: board.PrgBanks,
+			ChrBanks: board.ChrBanks,
+		}
+	})
+}
+
 func (m *Mapper0003) CpuMapRead(addr uint16, mappedAddr *uint32) bool {
 	if addr >= 0x8000 && addr <= 0xFFFF {
 		if m.PrgBanks == 1 {
@@ -39,6 +50,22 @@ func (m *Mapper0003) PpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bo
 	return false
 }
 
+func (m *Mapper0003) PrgRamMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF {
+		*mappedAddr = uint32(addr & 0x1FFF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0003) PrgRamMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF {
+		*mappedAddr = uint32(addr & 0x1FFF)
+		return true
+	}
+	return false
+}
+
 func (m *Mapper0003) Reset() {
 	m.chrBanksSelect = 0
 }
@@ -46,10 +73,21 @@ func (m *Mapper0003) Reset() {
 func (m *Mapper0003) Mirror() MIRROR {
 	return HARDWARE
 }
-func (m *Mapper0003) irqState() bool {
+func (m *Mapper0003) IrqState() bool {
 	return false
 }
-func (m *Mapper0003) irqClear() {
+func (m *Mapper0003) IrqClear() {
+}
+func (m *Mapper0003) Scanline() {
+}
+
+// state lists the registers SaveState and LoadState cover, in order.
+func (m *Mapper0003) state() []interface{} {
+	return []interface{}{&m.chrBanksSelect}
+}
+func (m *Mapper0003) SaveState(w io.Writer) error {
+	return writeState(w, m.state())
 }
-func (m *Mapper0003) scanline() {
+func (m *Mapper0003) LoadState(r io.Reader) error {
+	return readState(r, m.state())
 }
@@ -1,19 +1,224 @@
 package mapper
 
+import "io"
+
+// Mapper0004 is the MMC3 (TxROM). PRG is switched in 8KB and CHR in 1KB
+// banks, and a scanline counter clocked by the PPU raises IRQs.
 type Mapper0004 struct {
+	PrgBanks uint8
+	ChrBanks uint8
+
 	targetRegister uint8
 	prgBankMode    bool
 	chrInversion   bool
 	mirrorMode     MIRROR
-	register       uint32
+	register       [8]uint32
 	chrBank        [8]uint32
 	prgBank        [4]uint32
+	prgRamEnable   bool
+	prgRamProtect  bool
 	IRQActive      bool
 	IRQEnable      bool
-	IRQUpdate      bool
 	IRQCounter     uint16
 	IRQReload      uint16
-	ramStatic      []uint8
-	prgBanks       uint8
-	chrBanks       uint8
+}
+
+func init() {
+	Register(4, 0, func(board Board) Mapper {
+		return &Mapper0004{
+			PrgBanks: board.PrgBanks,
+			ChrBanks: board.ChrBanks,
+		}
+	})
+}
+
+func (m *Mapper0004) updateBanks() {
+	chrBanks1k := uint32(m.ChrBanks) * 8
+	if chrBanks1k == 0 {
+		chrBanks1k = 8
+	}
+	if m.chrInversion {
+		m.chrBank[0] = m.register[2]
+		m.chrBank[1] = m.register[3]
+		m.chrBank[2] = m.register[4]
+		m.chrBank[3] = m.register[5]
+		m.chrBank[4] = m.register[0] & 0xFE
+		m.chrBank[5] = m.register[0] | 0x01
+		m.chrBank[6] = m.register[1] & 0xFE
+		m.chrBank[7] = m.register[1] | 0x01
+	} else {
+		m.chrBank[0] = m.register[0] & 0xFE
+		m.chrBank[1] = m.register[0] | 0x01
+		m.chrBank[2] = m.register[1] & 0xFE
+		m.chrBank[3] = m.register[1] | 0x01
+		m.chrBank[4] = m.register[2]
+		m.chrBank[5] = m.register[3]
+		m.chrBank[6] = m.register[4]
+		m.chrBank[7] = m.register[5]
+	}
+	for i := range m.chrBank {
+		m.chrBank[i] = (m.chrBank[i] % chrBanks1k) * 0x0400
+	}
+
+	prgBanks8k := uint32(m.PrgBanks) * 2
+	if m.prgBankMode {
+		m.prgBank[0] = prgBanks8k - 2
+		m.prgBank[2] = m.register[6] % prgBanks8k
+	} else {
+		m.prgBank[0] = m.register[6] % prgBanks8k
+		m.prgBank[2] = prgBanks8k - 2
+	}
+	m.prgBank[1] = m.register[7] % prgBanks8k
+	m.prgBank[3] = prgBanks8k - 1
+	for i := range m.prgBank {
+		m.prgBank[i] *= 0x2000
+	}
+}
+
+func (m *Mapper0004) CpuMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr >= 0x8000 {
+		*mappedAddr = m.prgBank[(addr>>13)&0x03] + uint32(addr&0x1FFF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0004) CpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr < 0x8000 {
+		return false
+	}
+
+	even := addr&0x0001 == 0
+	switch {
+	case addr <= 0x9FFF:
+		if even {
+			m.targetRegister = data & 0x07
+			m.prgBankMode = data&0x40 != 0
+			m.chrInversion = data&0x80 != 0
+		} else {
+			m.register[m.targetRegister] = uint32(data)
+		}
+		m.updateBanks()
+	case addr <= 0xBFFF:
+		if even {
+			if data&0x01 != 0 {
+				m.mirrorMode = HORIZONTAL
+			} else {
+				m.mirrorMode = VERTICAL
+			}
+		} else {
+			m.prgRamEnable = data&0x80 != 0
+			m.prgRamProtect = data&0x40 != 0
+		}
+	case addr <= 0xDFFF:
+		if even {
+			m.IRQReload = uint16(data)
+		} else {
+			m.IRQCounter = 0
+		}
+	default:
+		if even {
+			m.IRQEnable = false
+			m.IRQActive = false
+		} else {
+			m.IRQEnable = true
+		}
+	}
+	return false
+}
+
+func (m *Mapper0004) PpuMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr < 0x2000 {
+		*mappedAddr = m.chrBank[addr>>10] + uint32(addr&0x03FF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0004) PpuMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr < 0x2000 && m.ChrBanks == 0 {
+		*mappedAddr = m.chrBank[addr>>10] + uint32(addr&0x03FF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0004) PrgRamMapRead(addr uint16, mappedAddr *uint32) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF && m.prgRamEnable {
+		*mappedAddr = uint32(addr & 0x1FFF)
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0004) PrgRamMapWrite(addr uint16, mappedAddr *uint32, data uint8) bool {
+	if addr >= 0x6000 && addr <= 0x7FFF && m.prgRamEnable {
+		if m.prgRamProtect {
+			*mappedAddr = 0xFFFFFFFF
+		} else {
+			*mappedAddr = uint32(addr & 0x1FFF)
+		}
+		return true
+	}
+	return false
+}
+
+func (m *Mapper0004) Reset() {
+	m.targetRegister = 0
+	m.prgBankMode = false
+	m.chrInversion = false
+	m.mirrorMode = HARDWARE
+	m.prgRamEnable = true
+	m.prgRamProtect = false
+
+	m.IRQActive = false
+	m.IRQEnable = false
+	m.IRQCounter = 0
+	m.IRQReload = 0
+
+	for i := range m.register {
+		m.register[i] = 0
+	}
+	m.register[7] = 1
+	m.updateBanks()
+}
+
+func (m *Mapper0004) Mirror() MIRROR {
+	return m.mirrorMode
+}
+func (m *Mapper0004) IrqState() bool {
+	return m.IRQActive
+}
+func (m *Mapper0004) IrqClear() {
+	m.IRQActive = false
+}
+
+// Scanline clocks the IRQ counter, which the PPU does once per rendered
+// line (A12 rising during the sprite fetches, cycle 260 with the usual
+// pattern table layout).
+func (m *Mapper0004) Scanline() {
+	if m.IRQCounter == 0 {
+		m.IRQCounter = m.IRQReload
+	} else {
+		m.IRQCounter--
+	}
+
+	if m.IRQCounter == 0 && m.IRQEnable {
+		m.IRQActive = true
+	}
+}
+
+// state lists the registers SaveState and LoadState cover, in order.
+func (m *Mapper0004) state() []interface{} {
+	return []interface{}{
+		&m.targetRegister, &m.prgBankMode, &m.chrInversion, &m.mirrorMode,
+		&m.register, &m.chrBank, &m.prgBank, &m.prgRamEnable, &m.prgRamProtect,
+		&m.IRQActive, &m.IRQEnable, &m.IRQCounter, &m.IRQReload,
+	}
+}
+func (m *Mapper0004) SaveState(w io.Writer) error {
+	return writeState(w, m.state())
+}
+func (m *Mapper0004) LoadState(r io.Reader) error {
+	return readState(r, m.state())
 }
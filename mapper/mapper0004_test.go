@@ -0,0 +1,89 @@
+package mapper
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMapper0004Banking(t *testing.T) {
+	m := &Mapper0004{PrgBanks: 16, ChrBanks: 16}
+	m.Reset()
+	mappedAddr := uint32(0)
+
+	m.CpuMapRead(0xE000, &mappedAddr)
+	assert.Equal(t, uint32(31*0x2000), mappedAddr)
+
+	m.CpuMapWrite(0x8000, &mappedAddr, 0x06)
+	m.CpuMapWrite(0x8001, &mappedAddr, 0x05)
+	m.CpuMapRead(0x8010, &mappedAddr)
+	assert.Equal(t, uint32(5*0x2000+0x10), mappedAddr)
+	m.CpuMapRead(0xC000, &mappedAddr)
+	assert.Equal(t, uint32(30*0x2000), mappedAddr)
+
+	// PRG mode 1 swaps $8000 and $C000
+	m.CpuMapWrite(0x8000, &mappedAddr, 0x46)
+	m.CpuMapRead(0x8000, &mappedAddr)
+	assert.Equal(t, uint32(30*0x2000), mappedAddr)
+	m.CpuMapRead(0xC000, &mappedAddr)
+	assert.Equal(t, uint32(5*0x2000), mappedAddr)
+
+	// R0 is a 2KB bank, the low bit is ignored
+	m.CpuMapWrite(0x8000, &mappedAddr, 0x00)
+	m.CpuMapWrite(0x8001, &mappedAddr, 0x0B)
+	m.PpuMapRead(0x0000, &mappedAddr)
+	assert.Equal(t, uint32(10*0x0400), mappedAddr)
+	m.PpuMapRead(0x0400, &mappedAddr)
+	assert.Equal(t, uint32(11*0x0400), mappedAddr)
+
+	m.CpuMapWrite(0xA000, &mappedAddr, 0x01)
+	assert.Equal(t, HORIZONTAL, m.Mirror())
+}
+
+func TestMapper0004Irq(t *testing.T) {
+	m := &Mapper0004{PrgBanks: 16, ChrBanks: 16}
+	m.Reset()
+	mappedAddr := uint32(0)
+
+	m.CpuMapWrite(0xC000, &mappedAddr, 3)
+	m.CpuMapWrite(0xC001, &mappedAddr, 0)
+	m.CpuMapWrite(0xE001, &mappedAddr, 0)
+
+	for i := 0; i < 3; i++ {
+		m.Scanline()
+		assert.False(t, m.IrqState())
+	}
+	m.Scanline()
+	assert.True(t, m.IrqState())
+
+	// $E000 acknowledges and disables
+	m.CpuMapWrite(0xE000, &mappedAddr, 0)
+	assert.False(t, m.IrqState())
+	for i := 0; i < 4; i++ {
+		m.Scanline()
+	}
+	assert.False(t, m.IrqState())
+}
+
+func TestMapper0004State(t *testing.T) {
+	m := &Mapper0004{PrgBanks: 16, ChrBanks: 16}
+	m.Reset()
+	mappedAddr := uint32(0)
+	m.CpuMapWrite(0x8000, &mappedAddr, 0x46)
+	m.CpuMapWrite(0x8001, &mappedAddr, 0x05)
+	m.CpuMapWrite(0xA000, &mappedAddr, 0x01)
+	m.CpuMapWrite(0xC000, &mappedAddr, 0x20)
+	m.CpuMapWrite(0xE001, &mappedAddr, 0x00)
+	m.Scanline()
+
+	var state bytes.Buffer
+	assert.NoError(t, m.SaveState(&state))
+
+	restored := &Mapper0004{PrgBanks: 16, ChrBanks: 16}
+	restored.Reset()
+	assert.NoError(t, restored.LoadState(bytes.NewReader(state.Bytes())))
+	assert.Equal(t, m, restored)
+
+	// A truncated state is reported
+	assert.Error(t, restored.LoadState(bytes.NewReader(state.Bytes()[:state.Len()-1])))
+}
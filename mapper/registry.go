@@ -0,0 +1,68 @@
+package mapper
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Board describes the cartridge a mapper is soldered onto, as far as the
+// image header tells. PRG banks are 16KB and CHR banks 8KB; ChrBanks is 0
+// when the board has CHR RAM. RAM sizes are in bytes.
+type Board struct {
+	Mapper    uint16
+	Submapper uint8
+
+	PrgBanks     uint8
+	ChrBanks     uint8
+	PrgRamSize   uint32
+	PrgNvramSize uint32
+	ChrRamSize   uint32
+	ChrNvramSize uint32
+
+	Mirror  MIRROR
+	Battery bool
+}
+
+// Factory builds a mapper for a board. It's called once per loaded
+// cartridge, before Reset.
+type Factory func(board Board) Mapper
+
+type boardId struct {
+	mapper    uint16
+	submapper uint8
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[boardId]Factory)
+)
+
+// Register makes a mapper available for the given iNES mapper number and
+// NES 2.0 submapper. A factory registered for submapper 0 is also used for
+// any submapper that has no factory of its own. Registering the same pair
+// twice panics.
+func Register(mapper uint16, submapper uint8, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("mapper: Register factory is nil")
+	}
+	id := boardId{mapper: mapper, submapper: submapper}
+	if _, dup := registry[id]; dup {
+		panic(fmt.Sprintf("mapper: Register called twice for mapper %d.%d", mapper, submapper))
+	}
+	registry[id] = factory
+}
+
+// Lookup returns the factory for a mapper and submapper.
+func Lookup(mapper uint16, submapper uint8) (Factory, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	if factory, ok := registry[boardId{mapper: mapper, submapper: submapper}]; ok {
+		return factory, true
+	}
+	factory, ok := registry[boardId{mapper: mapper, submapper: 0}]
+	return factory, ok
+}
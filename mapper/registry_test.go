@@ -0,0 +1,31 @@
+package mapper
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	factory, ok := Lookup(1, 0)
+	assert.True(t, ok)
+	m := factory(Board{PrgBanks: 16, ChrBanks: 0, PrgRamSize: 0x2000, Submapper: 5})
+	assert.Equal(t, uint8(5), m.(*Mapper0001).Submapper)
+
+	// Unregistered submappers fall back to submapper 0
+	_, ok = Lookup(4, 3)
+	assert.True(t, ok)
+	_, ok = Lookup(0xFFF, 0)
+	assert.False(t, ok)
+
+	Register(0xFFF, 2, func(board Board) Mapper {
+		return &Mapper0000{PrgBanks: board.PrgBanks}
+	})
+	_, ok = Lookup(0xFFF, 2)
+	assert.True(t, ok)
+	_, ok = Lookup(0xFFF, 0)
+	assert.False(t, ok)
+
+	assert.Panics(t, func() {
+		Register(0xFFF, 2, func(board Board) Mapper { return nil })
+	})
+}
@@ -0,0 +1,27 @@
+package mapper
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// writeState writes a mapper's registers, given as pointers to fixed-size
+// values, in order and little endian. readState reads them back from the
+// same list.
+func writeState(w io.Writer, fields []interface{}) error {
+	for _, field := range fields {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readState(r io.Reader, fields []interface{}) error {
+	for _, field := range fields {
+		if err := binary.Read(r, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
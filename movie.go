@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"nes-emu/nes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func readMovie(path string) (*nes.Movie, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return nes.ReadFM2(bufio.NewReader(file))
+}
+
+// writeMovie goes through a temporary file like saveState, so a failed
+// write keeps the previous movie.
+func writeMovie(path string, movie *nes.Movie) error {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = movie.WriteFM2(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// startMovie records to recordPath or plays playPath, read-only. The movie
+// is returned so that it can be written when the emulator exits.
+func startMovie(console *nes.Console, romPath string, recordPath string, playPath string) (*nes.Movie, error) {
+	if recordPath != "" {
+		name := strings.TrimSuffix(filepath.Base(romPath), filepath.Ext(romPath))
+		movie := &nes.Movie{ROMFilename: name}
+		return movie, console.RecordMovie(movie)
+	}
+	movie, err := readMovie(playPath)
+	if err != nil {
+		return nil, err
+	}
+	return movie, console.PlayMovie(movie, true)
+}
@@ -0,0 +1,289 @@
+package nes
+
+type APU struct {
+	pulse             [2]pulse
+	triangle          triangle
+	noise             noise
+	dmc               dmc
+	tables            *apuTables
+	clockCounter      uint32
+	frameClockCounter uint32
+	frameResetDelay   uint8
+
+	// level is the mixed output, out resamples its changes to the host's
+	// rate
+	level float64
+	out   resampler
+
+	// Frame counter mode and interrupt, set through $4017. The 5-step
+	// sequence never raises the interrupt. Writing $4017 restarts the
+	// sequence 3 or 4 CPU cycles later, see frameResetDelay.
+	fiveStepMode bool
+	irqInhibit   bool
+	frameIRQ     bool
+}
+
+// cpuFrequency is the NTSC CPU clock, which the APU runs on.
+const cpuFrequency = 21477272.0 / 12
+
+// apuTables are the noise periods and DMC rates, in CPU cycles. PAL
+// consoles have their own, tuned to their slower clock.
+type apuTables struct {
+	noise [16]uint16
+	dmc   [16]uint16
+}
+
+var ntscTables = apuTables{
+	noise: [16]uint16{4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068},
+	dmc:   [16]uint16{428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54},
+}
+
+var palTables = apuTables{
+	noise: [16]uint16{4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778},
+	dmc:   [16]uint16{398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50},
+}
+
+// Frame counter steps, in CPU cycles since the sequence started. The
+// 4-step sequence raises the interrupt during its last three cycles.
+const (
+	frameQuarter1    = 7457
+	frameHalf1       = 14913
+	frameQuarter3    = 22371
+	frameIRQStart    = 29828
+	frameHalf4       = 29829
+	frameFourStepEnd = 29830
+	frameHalf5       = 37281
+	frameFiveStepEnd = 37282
+)
+
+// lengthTable are the durations, in half frames, loaded by the top 5 bits
+// of $4003, $4007, $400B and $400F.
+var lengthTable = [32]uint8{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+// pulseTable and tndTable are the console's non-linear mixer, indexed by
+// the sum of the pulse levels and by 3 * triangle + 2 * noise + DMC.
+var pulseTable, tndTable = makeMixerTables()
+
+func makeMixerTables() (pulse [31]float64, tnd [203]float64) {
+	for n := 1; n < len(pulse); n++ {
+		pulse[n] = 95.52 / (8128.0/float64(n) + 100)
+	}
+	for n := 1; n < len(tnd); n++ {
+		tnd[n] = 163.67 / (24329.0/float64(n) + 100)
+	}
+	return pulse, tnd
+}
+
+// setTiming picks the noise and DMC tables of the console the game was
+// made for. Everything else runs at NTSC speed.
+func (a *APU) setTiming(timing Timing) {
+	a.tables = &ntscTables
+	if timing == TimingPAL || timing == TimingDendy {
+		a.tables = &palTables
+	}
+}
+
+func (a *APU) cpuRead(addr uint16, readOnly bool) uint8 {
+	data := uint8(0x00)
+	if addr == 0x4015 {
+		if a.pulse[0].length.counter > 0 {
+			data |= 0x01
+		}
+		if a.pulse[1].length.counter > 0 {
+			data |= 0x02
+		}
+		if a.triangle.length.counter > 0 {
+			data |= 0x04
+		}
+		if a.noise.length.counter > 0 {
+			data |= 0x08
+		}
+		if a.dmc.bytesRemaining > 0 {
+			data |= 0x10
+		}
+		if a.frameIRQ {
+			data |= 0x40
+		}
+		if a.dmc.irq {
+			data |= 0x80
+		}
+		// Reading the status acknowledges the frame interrupt
+		if !readOnly {
+			a.frameIRQ = false
+		}
+	}
+	return data
+}
+
+func (a *APU) cpuWrite(addr uint16, data uint8) {
+	switch {
+	case addr <= 0x4007:
+		a.pulse[(addr>>2)&0x01].write(addr&0x03, data)
+	case addr <= 0x400B:
+		a.triangle.write(addr&0x03, data)
+	case addr <= 0x400F:
+		a.noise.write(addr&0x03, data)
+		if addr == 0x400E {
+			a.noise.period = a.tables.noise[data&0x0F]
+		}
+	case addr <= 0x4013:
+		a.dmc.write(addr&0x03, data)
+		if addr == 0x4010 {
+			a.dmc.rate = a.tables.dmc[data&0x0F]
+		}
+	case addr == 0x4015:
+		a.pulse[0].length.setEnable(data&0x01 != 0)
+		a.pulse[1].length.setEnable(data&0x02 != 0)
+		a.triangle.length.setEnable(data&0x04 != 0)
+		a.noise.length.setEnable(data&0x08 != 0)
+		a.dmc.setEnable(data&0x10 != 0)
+	case addr == 0x4017:
+		a.fiveStepMode = data&0x80 != 0
+		a.irqInhibit = data&0x40 != 0
+		if a.irqInhibit {
+			a.frameIRQ = false
+		}
+		// The sequence restarts 3 cycles later when written on an APU
+		// cycle, 4 when written between two. clock has already counted
+		// the write cycle.
+		a.frameResetDelay = 3
+		if (a.clockCounter-1)%2 != 0 {
+			a.frameResetDelay++
+		}
+	}
+}
+
+// quarterFrame clocks the envelopes and the triangle's linear counter.
+func (a *APU) quarterFrame() {
+	a.pulse[0].envelope.clock()
+	a.pulse[1].envelope.clock()
+	a.noise.envelope.clock()
+	a.triangle.clockLinearCounter()
+}
+
+// halfFrame clocks the length counters and the sweep units.
+func (a *APU) halfFrame() {
+	a.pulse[0].length.clock()
+	a.pulse[1].length.clock()
+	a.triangle.length.clock()
+	a.noise.length.clock()
+	a.pulse[0].clockSweep()
+	a.pulse[1].clockSweep()
+}
+
+func (a *APU) setFrameIRQ() {
+	if !a.irqInhibit {
+		a.frameIRQ = true
+	}
+}
+
+// clockFrameCounter steps the frame sequence, 4 steps of a quarter of a
+// frame, or 5 of which the fourth does nothing.
+func (a *APU) clockFrameCounter() {
+	if a.frameResetDelay > 0 {
+		a.frameResetDelay--
+		if a.frameResetDelay == 0 {
+			a.frameClockCounter = 0
+			// The 5-step sequence starts with a half frame
+			if a.fiveStepMode {
+				a.quarterFrame()
+				a.halfFrame()
+			}
+			return
+		}
+	}
+
+	a.frameClockCounter++
+	switch a.frameClockCounter {
+	case frameQuarter1, frameQuarter3:
+		a.quarterFrame()
+	case frameHalf1:
+		a.quarterFrame()
+		a.halfFrame()
+	case frameIRQStart:
+		if !a.fiveStepMode {
+			a.setFrameIRQ()
+		}
+	case frameHalf4:
+		if !a.fiveStepMode {
+			a.quarterFrame()
+			a.halfFrame()
+			a.setFrameIRQ()
+		}
+	case frameFourStepEnd:
+		if !a.fiveStepMode {
+			a.setFrameIRQ()
+			a.frameClockCounter = 0
+		}
+	case frameHalf5:
+		a.quarterFrame()
+		a.halfFrame()
+	case frameFiveStepEnd:
+		a.frameClockCounter = 0
+	}
+}
+
+// clock runs one CPU cycle. The pulse timers only count APU cycles, every
+// other CPU cycle.
+func (a *APU) clock() {
+	a.clockFrameCounter()
+	a.triangle.clockTimer()
+	a.noise.clockTimer()
+	a.dmc.clockTimer()
+	if a.clockCounter%2 == 0 {
+		a.pulse[0].clockTimer()
+		a.pulse[1].clockTimer()
+	}
+	if level := a.mix(); level != a.level {
+		a.out.addDelta(level - a.level)
+		a.level = level
+	}
+	a.out.clock()
+	a.clockCounter++
+}
+
+// reset silences every channel, like clearing $4015, and restarts the
+// frame counter in the mode it was in.
+func (a *APU) reset() {
+	a.cpuWrite(0x4015, 0x00)
+	a.dmc.silence = true
+	a.frameIRQ = false
+	a.frameClockCounter = 0
+	a.frameResetDelay = 0
+}
+
+// power clears every register, the frame counter starting in 4-step mode.
+func (a *APU) power() {
+	tables, out := a.tables, a.out
+	*a = *NewAPU()
+	a.tables, a.out = tables, out
+	a.noise.period = tables.noise[0]
+	a.dmc.rate = tables.dmc[0]
+}
+
+// mix is the output level, from 0 to about 1.
+func (a *APU) mix() float64 {
+	pulse := a.pulse[0].output() + a.pulse[1].output()
+	tnd := 3*int(a.triangle.output()) + 2*int(a.noise.output()) + int(a.dmc.output())
+	return pulseTable[pulse] + tndTable[tnd]
+}
+
+// setSampleRate sets the rate of the samples passed to the emit function
+// of out, 0 stopping them.
+func (a *APU) setSampleRate(sampleRate float64) {
+	a.out.setRates(cpuFrequency, sampleRate)
+}
+
+func NewAPU() *APU {
+	return &APU{
+		pulse:  [2]pulse{{onesComplement: true}, {}},
+		tables: &ntscTables,
+		noise:  noise{shift: 1, period: ntscTables.noise[0]},
+		// The DMC output is silent until a sample byte reaches it, so a
+		// level set through $4011 holds
+		dmc: dmc{rate: ntscTables.dmc[0], bitsRemaining: 8, silence: true},
+	}
+}
@@ -0,0 +1,417 @@
+package nes
+
+// lengthCounter silences a channel after a number of half frames, unless
+// halted. Clearing its bit in $4015 empties it and keeps it empty.
+type lengthCounter struct {
+	enable  bool
+	halt    bool
+	counter uint8
+}
+
+func (l *lengthCounter) setEnable(enable bool) {
+	l.enable = enable
+	if !enable {
+		l.counter = 0
+	}
+}
+
+func (l *lengthCounter) load(data uint8) {
+	if l.enable {
+		l.counter = lengthTable[data>>3]
+	}
+}
+
+func (l *lengthCounter) clock() {
+	if !l.halt && l.counter > 0 {
+		l.counter--
+	}
+}
+
+// envelope is the volume of the pulse and noise channels: constant, or
+// decaying from 15 to 0 every period + 1 quarter frames, and looping with
+// the length counter halt bit.
+type envelope struct {
+	start    bool
+	loop     bool
+	constant bool
+	period   uint8
+	divider  uint8
+	decay    uint8
+}
+
+// write takes the low six bits of $4000, $4004 and $400C.
+func (e *envelope) write(data uint8) {
+	e.loop = data&0x20 != 0
+	e.constant = data&0x10 != 0
+	e.period = data & 0x0F
+}
+
+func (e *envelope) clock() {
+	if e.start {
+		e.start = false
+		e.decay = 15
+		e.divider = e.period
+		return
+	}
+	if e.divider > 0 {
+		e.divider--
+		return
+	}
+	e.divider = e.period
+	if e.decay > 0 {
+		e.decay--
+	} else if e.loop {
+		e.decay = 15
+	}
+}
+
+func (e *envelope) volume() uint8 {
+	if e.constant {
+		return e.period
+	}
+	return e.decay
+}
+
+// sweep bends the period of a pulse channel every period + 1 half frames,
+// by the period shifted right, up or down.
+type sweep struct {
+	enable  bool
+	period  uint8
+	negate  bool
+	shift   uint8
+	divider uint8
+	reload  bool
+}
+
+func (s *sweep) write(data uint8) {
+	s.enable = data&0x80 != 0
+	s.period = (data >> 4) & 0x07
+	s.negate = data&0x08 != 0
+	s.shift = data & 0x07
+	s.reload = true
+}
+
+// pulseDuty are the waveforms of the four duty cycles, 12.5%, 25%, 50% and
+// 25% inverted. The sequencer counts down, so they're read in the order 0,
+// 7, 6, ..., 1.
+var pulseDuty = [4][8]uint8{
+	{0, 1, 0, 0, 0, 0, 0, 0},
+	{0, 1, 1, 0, 0, 0, 0, 0},
+	{0, 1, 1, 1, 1, 0, 0, 0},
+	{1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+// pulse is one of the two square wave channels, $4000-$4003 and
+// $4004-$4007. Its 11-bit timer steps the duty sequencer, so the tone is
+// 1.789773 MHz / (16 * (period + 1)).
+type pulse struct {
+	length   lengthCounter
+	envelope envelope
+	sweep    sweep
+	duty     uint8
+	period   uint16
+	timer    uint16
+	step     uint8
+	// Pulse 1 negates sweeps with the ones' complement, one lower than
+	// pulse 2's two's complement
+	onesComplement bool
+}
+
+func (p *pulse) write(reg uint16, data uint8) {
+	switch reg {
+	case 0:
+		p.duty = data >> 6
+		p.length.halt = data&0x20 != 0
+		p.envelope.write(data)
+	case 1:
+		p.sweep.write(data)
+	case 2:
+		p.period = (p.period & 0xFF00) | uint16(data)
+	case 3:
+		p.period = (uint16(data)&0x07)<<8 | (p.period & 0x00FF)
+		p.length.load(data)
+		p.envelope.start = true
+		// Writing the high byte restarts the waveform
+		p.step = 0
+	}
+}
+
+// sweepTarget is the period the sweep unit is heading to. It can be out of
+// range either way, only targets up to $7FF are applied.
+func (p *pulse) sweepTarget() int {
+	change := int(p.period >> p.sweep.shift)
+	if !p.sweep.negate {
+		return int(p.period) + change
+	}
+	if p.onesComplement {
+		change++
+	}
+	return int(p.period) - change
+}
+
+// muted tells whether the sweep unit silences the channel, which it does
+// even when disabled.
+func (p *pulse) muted() bool {
+	return p.period < 8 || p.sweepTarget() > 0x7FF
+}
+
+// clockSweep runs every half frame.
+func (p *pulse) clockSweep() {
+	if p.sweep.divider == 0 && p.sweep.enable && p.sweep.shift > 0 && !p.muted() {
+		if target := p.sweepTarget(); target >= 0 {
+			p.period = uint16(target)
+		}
+	}
+	if p.sweep.divider == 0 || p.sweep.reload {
+		p.sweep.divider = p.sweep.period
+		p.sweep.reload = false
+	} else {
+		p.sweep.divider--
+	}
+}
+
+// clockTimer runs every APU cycle, every other CPU cycle.
+func (p *pulse) clockTimer() {
+	if p.timer > 0 {
+		p.timer--
+		return
+	}
+	p.timer = p.period
+	p.step = (p.step - 1) & 0x07
+}
+
+// output is the channel level, 0 to 15.
+func (p *pulse) output() uint8 {
+	if p.length.counter == 0 || p.muted() {
+		return 0
+	}
+	return pulseDuty[p.duty][p.step] * p.envelope.volume()
+}
+
+// triangleSequence is the 32-step ramp the triangle channel plays.
+var triangleSequence = [32]uint8{
+	15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// triangle is the triangle channel, $4008-$400B. It has no volume, its
+// linear counter stops it after a time set in 1/240 s steps.
+type triangle struct {
+	length           lengthCounter
+	control          bool
+	linearReload     uint8
+	linearCounter    uint8
+	linearReloadFlag bool
+	period           uint16
+	timer            uint16
+	step             uint8
+}
+
+func (t *triangle) write(reg uint16, data uint8) {
+	switch reg {
+	case 0:
+		// The control bit is also the length counter halt
+		t.control = data&0x80 != 0
+		t.length.halt = t.control
+		t.linearReload = data & 0x7F
+	case 2:
+		t.period = (t.period & 0xFF00) | uint16(data)
+	case 3:
+		t.period = (uint16(data)&0x07)<<8 | (t.period & 0x00FF)
+		t.length.load(data)
+		t.linearReloadFlag = true
+	}
+}
+
+// clockTimer runs every CPU cycle. The sequence only moves while both
+// counters run, so a stopped triangle holds its level.
+func (t *triangle) clockTimer() {
+	if t.timer > 0 {
+		t.timer--
+		return
+	}
+	t.timer = t.period
+	if t.length.counter > 0 && t.linearCounter > 0 {
+		t.step = (t.step + 1) & 0x1F
+	}
+}
+
+// clockLinearCounter runs every quarter frame.
+func (t *triangle) clockLinearCounter() {
+	if t.linearReloadFlag {
+		t.linearCounter = t.linearReload
+	} else if t.linearCounter > 0 {
+		t.linearCounter--
+	}
+	if !t.control {
+		t.linearReloadFlag = false
+	}
+}
+
+func (t *triangle) output() uint8 {
+	return triangleSequence[t.step]
+}
+
+// noise is the pseudo-random channel, $400C-$400F. Its 15-bit shift
+// register feeds back bit 1, or bit 6 in the short mode which repeats
+// every 93 steps and sounds metallic.
+type noise struct {
+	length   lengthCounter
+	envelope envelope
+	mode     bool
+	period   uint16
+	timer    uint16
+	shift    uint16
+}
+
+// write leaves the period to the APU, it depends on the console.
+func (n *noise) write(reg uint16, data uint8) {
+	switch reg {
+	case 0:
+		n.length.halt = data&0x20 != 0
+		n.envelope.write(data)
+	case 2:
+		n.mode = data&0x80 != 0
+	case 3:
+		n.length.load(data)
+		n.envelope.start = true
+	}
+}
+
+// clockTimer runs every CPU cycle.
+func (n *noise) clockTimer() {
+	if n.timer > 0 {
+		n.timer--
+		return
+	}
+	n.timer = n.period - 1
+	tap := uint16(1)
+	if n.mode {
+		tap = 6
+	}
+	feedback := (n.shift ^ n.shift>>tap) & 0x01
+	n.shift = n.shift>>1 | feedback<<14
+}
+
+func (n *noise) output() uint8 {
+	if n.length.counter == 0 || n.shift&0x01 != 0 {
+		return 0
+	}
+	return n.envelope.volume()
+}
+
+// dmc is the delta modulation channel, $4010-$4013. It plays 1-bit deltas
+// fetched from $C000-$FFFF, one byte at a time: the bus reads the byte for
+// it (see needsSample) and the CPU waits meanwhile.
+type dmc struct {
+	irqEnable bool
+	loop      bool
+	rate      uint16
+	timer     uint16
+	level     uint8
+
+	sampleAddress  uint16
+	sampleLength   uint16
+	address        uint16
+	bytesRemaining uint16
+
+	buffer        uint8
+	bufferFull    bool
+	shift         uint8
+	bitsRemaining uint8
+	silence       bool
+
+	irq bool
+}
+
+// write leaves the rate to the APU, it depends on the console.
+func (d *dmc) write(reg uint16, data uint8) {
+	switch reg {
+	case 0:
+		d.irqEnable = data&0x80 != 0
+		d.loop = data&0x40 != 0
+		if !d.irqEnable {
+			d.irq = false
+		}
+	case 1:
+		d.level = data & 0x7F
+	case 2:
+		d.sampleAddress = 0xC000 | uint16(data)<<6
+	case 3:
+		d.sampleLength = uint16(data)<<4 | 0x0001
+	}
+}
+
+// setEnable handles bit 4 of $4015: clearing it stops the sample after the
+// byte being played, setting it restarts the sample if it had ended. Both
+// acknowledge the interrupt.
+func (d *dmc) setEnable(enable bool) {
+	d.irq = false
+	if !enable {
+		d.bytesRemaining = 0
+	} else if d.bytesRemaining == 0 {
+		d.restart()
+	}
+}
+
+func (d *dmc) restart() {
+	d.address = d.sampleAddress
+	d.bytesRemaining = d.sampleLength
+}
+
+// needsSample tells the bus to fetch the byte at address for load.
+func (d *dmc) needsSample() bool {
+	return !d.bufferFull && d.bytesRemaining > 0
+}
+
+func (d *dmc) load(data uint8) {
+	d.buffer = data
+	d.bufferFull = true
+	// The address wraps to $8000
+	d.address++
+	if d.address == 0x0000 {
+		d.address = 0x8000
+	}
+	d.bytesRemaining--
+	if d.bytesRemaining == 0 {
+		if d.loop {
+			d.restart()
+		} else if d.irqEnable {
+			d.irq = true
+		}
+	}
+}
+
+// clockTimer runs every CPU cycle, every rate cycles a bit moves the level
+// up or down by 2.
+func (d *dmc) clockTimer() {
+	if d.timer > 0 {
+		d.timer--
+		return
+	}
+	d.timer = d.rate - 1
+
+	if !d.silence {
+		if d.shift&0x01 != 0 {
+			if d.level <= 125 {
+				d.level += 2
+			}
+		} else if d.level >= 2 {
+			d.level -= 2
+		}
+	}
+	d.shift >>= 1
+	d.bitsRemaining--
+	if d.bitsRemaining == 0 {
+		d.bitsRemaining = 8
+		d.silence = !d.bufferFull
+		if d.bufferFull {
+			d.shift = d.buffer
+			d.bufferFull = false
+		}
+	}
+}
+
+func (d *dmc) output() uint8 {
+	return d.level
+}
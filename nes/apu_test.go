@@ -0,0 +1,268 @@
+package nes
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNoisePeriod(t *testing.T) {
+	apu := NewAPU()
+	apu.setTiming(TimingNTSC)
+	apu.cpuWrite(0x400E, 0x00)
+	for _, test := range []struct {
+		mode   uint8
+		length int
+	}{{0x00, 32767}, {0x80, 93}} {
+		apu.noise.shift = 1
+		apu.cpuWrite(0x400E, test.mode)
+		steps := 0
+		for {
+			for i := uint16(0); i < apu.noise.period; i++ {
+				apu.noise.clockTimer()
+			}
+			steps++
+			if apu.noise.shift == 1 {
+				break
+			}
+		}
+		assert.Equal(t, test.length, steps)
+	}
+
+	apu.setTiming(TimingPAL)
+	apu.cpuWrite(0x400E, 0x0F)
+	assert.Equal(t, uint16(3778), apu.noise.period)
+}
+
+func TestTriangleLinearCounter(t *testing.T) {
+	apu := NewAPU()
+	apu.cpuWrite(0x4015, 0x04)
+	apu.cpuWrite(0x4008, 0x03)
+	apu.cpuWrite(0x400A, 0x00)
+	apu.cpuWrite(0x400B, 0x00)
+
+	var steps []uint8
+	for i := 0; i < 5; i++ {
+		apu.triangle.clockLinearCounter()
+		apu.triangle.clockTimer()
+		steps = append(steps, apu.triangle.step)
+	}
+	// Reloaded with 3 on the first quarter frame, then counted down
+	assert.Equal(t, []uint8{1, 2, 3, 3, 3}, steps)
+	assert.Equal(t, triangleSequence[3], apu.triangle.output())
+}
+
+func TestDMCFetch(t *testing.T) {
+	console := newTestConsole(t, []byte{
+		0xA9, 0x00, // LDA #$00
+		0x8D, 0x12, 0x40, // STA $4012
+		0x8D, 0x13, 0x40, // STA $4013
+		0xA9, 0x80, // LDA #$80
+		0x8D, 0x10, 0x40, // STA $4010
+		0xA9, 0x10, // LDA #$10
+		0x8D, 0x15, 0x40, // STA $4015
+		0xEA, // NOP
+	})
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, console.StepInstruction())
+	}
+	assert.True(t, console.apu.dmc.needsSample())
+
+	// The CPU waits while the byte is fetched
+	cycles := console.cpu.cycleCount
+	assert.NoError(t, console.StepInstruction())
+	assert.Equal(t, uint64(2+dmcStallCycles), console.cpu.cycleCount-cycles)
+	assert.Equal(t, uint8(0xA9), console.apu.dmc.buffer)
+
+	// The sample was one byte long, its end raises the interrupt
+	assert.True(t, console.apu.dmc.irq)
+	assert.Equal(t, uint8(0x80), console.apu.cpuRead(0x4015, false))
+	console.apu.cpuWrite(0x4015, 0x00)
+	assert.False(t, console.apu.dmc.irq)
+}
+
+func TestDMCDirectLoad(t *testing.T) {
+	apu := NewAPU()
+	apu.cpuWrite(0x4011, 0x40)
+	// No sample has been played, the level holds through the first bits
+	for i := 0; i < 16*int(apu.dmc.rate); i++ {
+		apu.dmc.clockTimer()
+	}
+	assert.Equal(t, uint8(0x40), apu.dmc.output())
+
+	apu.reset()
+	apu.cpuWrite(0x4011, 0x20)
+	for i := 0; i < 16*int(apu.dmc.rate); i++ {
+		apu.dmc.clockTimer()
+	}
+	assert.Equal(t, uint8(0x20), apu.dmc.output())
+}
+
+func TestPulseSequencer(t *testing.T) {
+	apu := NewAPU()
+	apu.cpuWrite(0x4015, 0x01)
+	apu.cpuWrite(0x4000, 0x5F) // 25% duty, constant volume 15
+	apu.cpuWrite(0x4002, 0x08)
+	apu.cpuWrite(0x4003, 0x00)
+
+	var wave []uint8
+	for i := 0; i < 8*9; i++ {
+		if i%9 == 0 {
+			wave = append(wave, apu.pulse[0].output())
+		}
+		apu.pulse[0].clockTimer()
+	}
+	// A step every period + 1 APU cycles, read from step 0 down
+	assert.Equal(t, []uint8{0, 0, 0, 0, 0, 0, 15, 15}, wave)
+
+	// Writing the high period byte restarts the sequence
+	apu.pulse[0].clockTimer()
+	assert.Equal(t, uint8(7), apu.pulse[0].step)
+	apu.cpuWrite(0x4003, 0x00)
+	assert.Equal(t, uint8(0), apu.pulse[0].step)
+
+	// Periods under 8 are muted
+	apu.cpuWrite(0x4002, 0x07)
+	apu.pulse[0].step = 1
+	assert.Equal(t, uint8(0), apu.pulse[0].output())
+}
+
+func TestLengthCounter(t *testing.T) {
+	apu := NewAPU()
+	apu.cpuWrite(0x4015, 0x01)
+	apu.cpuWrite(0x4000, 0x30)
+	apu.cpuWrite(0x4003, 0x18) // 2 half frames
+	assert.Equal(t, uint8(0x01), apu.cpuRead(0x4015, true))
+
+	// Halted, the counter keeps its value
+	apu.cpuWrite(0x4000, 0x20)
+	apu.halfFrame()
+	assert.Equal(t, uint8(2), apu.pulse[0].length.counter)
+	apu.cpuWrite(0x4000, 0x00)
+	apu.halfFrame()
+	apu.halfFrame()
+	assert.Equal(t, uint8(0x00), apu.cpuRead(0x4015, true))
+
+	// Disabled channels don't load
+	apu.cpuWrite(0x4015, 0x00)
+	apu.cpuWrite(0x4003, 0x08)
+	assert.Equal(t, uint8(0), apu.pulse[0].length.counter)
+	apu.cpuWrite(0x4015, 0x02)
+	apu.cpuWrite(0x4007, 0x08)
+	assert.Equal(t, uint8(254), apu.pulse[1].length.counter)
+	apu.cpuWrite(0x4015, 0x00)
+	assert.Equal(t, uint8(0), apu.pulse[1].length.counter)
+}
+
+func TestEnvelope(t *testing.T) {
+	apu := NewAPU()
+	apu.cpuWrite(0x4015, 0x08)
+	apu.cpuWrite(0x400C, 0x01) // decay every 2 quarter frames
+	apu.cpuWrite(0x400F, 0x08)
+
+	var volumes []uint8
+	for i := 0; i < 34; i++ {
+		apu.quarterFrame()
+		volumes = append(volumes, apu.noise.envelope.volume())
+	}
+	assert.Equal(t, []uint8{15, 15, 14, 14, 13}, volumes[:5])
+	assert.Equal(t, []uint8{1, 1, 0, 0, 0, 0}, volumes[28:])
+
+	// With the loop bit it starts again from 15
+	apu.cpuWrite(0x400C, 0x20)
+	apu.quarterFrame()
+	assert.Equal(t, uint8(15), apu.noise.envelope.volume())
+}
+
+func TestSweep(t *testing.T) {
+	apu := NewAPU()
+	for _, addr := range []uint16{0x4000, 0x4004} {
+		apu.cpuWrite(addr+1, 0x89) // enabled, every half frame, down by period >> 1
+		apu.cpuWrite(addr+2, 0x00)
+		apu.cpuWrite(addr+3, 0x01)
+	}
+	// Pulse 1 subtracts one more than pulse 2
+	assert.Equal(t, 0x7F, apu.pulse[0].sweepTarget())
+	assert.Equal(t, 0x80, apu.pulse[1].sweepTarget())
+	apu.halfFrame()
+	assert.Equal(t, uint16(0x7F), apu.pulse[0].period)
+	assert.Equal(t, uint16(0x80), apu.pulse[1].period)
+
+	// Targets above $7FF mute the channel even with the sweep disabled
+	apu.cpuWrite(0x4015, 0x01)
+	apu.cpuWrite(0x4000, 0xBF)
+	apu.cpuWrite(0x4001, 0x01)
+	apu.cpuWrite(0x4002, 0xFF)
+	apu.cpuWrite(0x4003, 0x06)
+	assert.True(t, apu.pulse[0].muted())
+	apu.cpuWrite(0x4001, 0x03)
+	assert.False(t, apu.pulse[0].muted())
+}
+
+func TestFrameCounterTiming(t *testing.T) {
+	for _, test := range []struct {
+		odd    bool
+		cycles int
+	}{{false, 3 + frameIRQStart}, {true, 4 + frameIRQStart}} {
+		apu := NewAPU()
+		if test.odd {
+			apu.clock()
+		}
+		apu.clock()
+		apu.cpuWrite(0x4017, 0x00)
+		cycles := 0
+		for !apu.frameIRQ {
+			apu.clock()
+			cycles++
+		}
+		assert.Equal(t, test.cycles, cycles)
+	}
+
+	// The 5-step sequence clocks the units as soon as it starts
+	apu := NewAPU()
+	apu.cpuWrite(0x4015, 0x01)
+	apu.cpuWrite(0x4003, 0x18)
+	apu.clock()
+	apu.cpuWrite(0x4017, 0x80)
+	for i := 0; i < 3; i++ {
+		apu.clock()
+	}
+	assert.Equal(t, uint8(1), apu.pulse[0].length.counter)
+}
+
+func TestFrameIRQOnSystem(t *testing.T) {
+	// The 4-step sequence restarts 3 CPU cycles after a $4017 write made on
+	// an APU cycle, 4 after one made between two, then sets the interrupt
+	// flag on its cycles 29828, 29829 and 29830
+	delays := map[uint64]bool{}
+	for _, program := range [][]byte{
+		{0xA9, 0x00, 0x8D, 0x17, 0x40},             // LDA #$00, STA $4017
+		{0xA5, 0x00, 0xA9, 0x00, 0x8D, 0x17, 0x40}, // LDA $00 first
+	} {
+		console := newTimingConsole(t, program)
+		bus := console.bus
+		for console.cpu.pc < 0xC000+uint16(len(program)) {
+			assert.NoError(t, console.StepInstruction())
+		}
+		// The write was the last cycle of STA
+		write := cpuCycle(bus) - 1
+
+		var set []uint64
+		for cycle := write + 1; cycle <= write+4+frameFourStepEnd+2; cycle++ {
+			for cpuCycle(bus) <= cycle {
+				bus.clock()
+			}
+			// Acknowledge it every time, to see each cycle it's set on
+			if bus.cpuRead(0x4015, false)&0x40 != 0 {
+				set = append(set, cycle-write)
+			}
+		}
+		if assert.Len(t, set, 3) {
+			delay := set[0] - frameIRQStart
+			assert.Contains(t, []uint64{3, 4}, delay)
+			assert.Equal(t, []uint64{delay + frameIRQStart, delay + frameHalf4, delay + frameFourStepEnd}, set)
+			delays[delay] = true
+		}
+	}
+	// Both kinds of write were tried
+	assert.Len(t, delays, 2)
+}
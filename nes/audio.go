@@ -0,0 +1,74 @@
+package nes
+
+import "sync"
+
+// audioBufferSeconds is how much sound the audio buffer holds. Rate control
+// keeps it about half full, so that's the latency it adds.
+const audioBufferSeconds = 0.15
+
+// maxRateDelta is how far rate control bends the sample rate, 0.5% or about
+// a tenth of a semitone, which can't be heard.
+const maxRateDelta = 0.005
+
+// rateControlSpan is how far from half full the audio buffer gets before
+// rate control bends by the whole maxRateDelta. It's narrow so the buffer
+// stays near the middle even when frames are paced by a 59.94 Hz display.
+const rateControlSpan = 0.25
+
+// AudioBuffer is the ring of samples between the emulator, which writes
+// them as it runs, and the audio device, which reads them from its own
+// thread at its own pace.
+type AudioBuffer struct {
+	mu      sync.Mutex
+	samples []float32
+	read    int
+	count   int
+	last    float32
+}
+
+func newAudioBuffer(size int) *AudioBuffer {
+	return &AudioBuffer{samples: make([]float32, size)}
+}
+
+// write appends a sample, dropping it when the buffer is full: the reader
+// has fallen behind and would only hear it late.
+func (b *AudioBuffer) write(sample float32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count == len(b.samples) {
+		return
+	}
+	b.samples[(b.read+b.count)%len(b.samples)] = sample
+	b.count++
+}
+
+// Read fills out with the oldest samples and returns how many there were.
+// When it runs out, the rest of out holds the last sample read, which
+// fades less abruptly than silence.
+func (b *AudioBuffer) Read(out []float32) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for ; n < len(out) && b.count > 0; n++ {
+		b.last = b.samples[b.read]
+		b.read = (b.read + 1) % len(b.samples)
+		b.count--
+		out[n] = b.last
+	}
+	for i := n; i < len(out); i++ {
+		out[i] = b.last
+	}
+	return n
+}
+
+// Len is the number of samples waiting to be read.
+func (b *AudioBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+// Fill is how full the buffer is, from 0 to 1.
+func (b *AudioBuffer) Fill() float64 {
+	return float64(b.Len()) / float64(len(b.samples))
+}
@@ -0,0 +1,57 @@
+package nes
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAudioBuffer(t *testing.T) {
+	buffer := newAudioBuffer(4)
+	for i := 1; i <= 3; i++ {
+		buffer.write(float32(i))
+	}
+	out := make([]float32, 2)
+	assert.Equal(t, 2, buffer.Read(out))
+	assert.Equal(t, []float32{1, 2}, out)
+
+	// Writes wrap around, and are dropped once the buffer is full
+	for i := 4; i <= 8; i++ {
+		buffer.write(float32(i))
+	}
+	assert.Equal(t, 1.0, buffer.Fill())
+
+	// An underrun holds the last sample
+	out = make([]float32, 6)
+	assert.Equal(t, 4, buffer.Read(out))
+	assert.Equal(t, []float32{3, 4, 5, 6, 6, 6}, out)
+	assert.Zero(t, buffer.Len())
+}
+
+func TestRateControl(t *testing.T) {
+	console := newTestConsole(t, []byte{0x4C, 0x00, 0xC0}) // JMP $C000
+	console.SetSampleFrequency(44100)
+	assert.NoError(t, console.StepFrame())
+
+	// The same number of samples every frame without rate control, give or
+	// take the fraction carried over
+	frameSamples := func() int {
+		console.AudioBuffer().Read(make([]float32, console.AudioBuffer().Len()))
+		assert.NoError(t, console.StepFrame())
+		return console.AudioBuffer().Len()
+	}
+	exact := frameSamples()
+	assert.InDelta(t, exact, frameSamples(), 1)
+
+	// An emptier buffer is filled up to 0.5% faster, a full one slower
+	console.SetRateControl(true)
+	samples := frameSamples()
+	assert.Greater(t, samples, exact+1)
+	assert.LessOrEqual(t, float64(samples), float64(exact)*(1+maxRateDelta)+1)
+	for console.AudioBuffer().Fill() < 1 {
+		assert.NoError(t, console.StepFrame())
+	}
+	assert.InDelta(t, (1-maxRateDelta)*console.apu.out.baseRatio, console.apu.out.ratio, 1e-12)
+
+	console.SetRateControl(false)
+	assert.Equal(t, console.apu.out.baseRatio, console.apu.out.ratio)
+}
@@ -0,0 +1,273 @@
+package nes
+
+import (
+	"math"
+	"unsafe"
+)
+
+// dmcStallCycles is how long the CPU waits while the DMC fetches a sample
+// byte. It's the usual case: a fetch landing on a CPU write, or during OAM
+// DMA, takes less on the real console.
+const dmcStallCycles = 4
+
+type Bus struct {
+	systemClockCounter uint64
+	cpuRam             []uint8
+	apu                *APU
+	cpu                *CPU
+	ppu                *PPU
+	cartridge          *Cartridge
+	controllerState    [2]uint8
+	controller         [2]uint8
+	buttons            [2]uint8
+	turbo              [2]uint8
+	turboRate          [2]uint8
+	moviePlaying       bool
+	movieButtons       [2]uint8
+	controllerStrobe   bool
+	openBus            uint8
+	dmaPage            uint8
+	dmaAddr            uint8
+	dmaData            uint8
+	dmaTransfer        bool
+	dmaDummy           bool
+	dmcStall           uint8
+	audio              *AudioBuffer
+	rateControl        bool
+	trace              *tracer
+}
+
+func (b *Bus) cpuWrite(addr uint16, data uint8) {
+	b.openBus = data
+
+	if b.cartridge.cpuWrite(addr, data) {
+
+	} else if addr >= 0x0000 && addr <= 0x1FFF {
+		b.cpuRam[addr&0x07FF] = data
+	} else if addr >= 0x2000 && addr <= 0x3FFF {
+		b.ppu.cpuWrite(addr&0x0007, data)
+	} else if (addr >= 0x4000 && addr <= 0x4013) || addr == 0x4015 || addr == 0x4017 {
+		b.apu.cpuWrite(addr, data)
+	} else if addr == 0x4014 {
+		b.dmaPage = data
+		b.dmaAddr = 0x00
+		b.dmaTransfer = true
+	} else if addr == 0x4016 {
+		// Bit 0 is the strobe of both ports. The controllers reload their
+		// shift registers for as long as it's high, and keep the buttons
+		// of that moment once it goes low.
+		b.controllerStrobe = data&0x01 != 0
+		if b.controllerStrobe {
+			b.controllerState = b.controller
+		}
+	}
+}
+
+func (b *Bus) cpuRead(addr uint16, readOnly bool) uint8 {
+	data := uint8(0)
+	if b.cartridge.cpuRead(addr, &data) {
+
+	} else if addr >= 0x0000 && addr <= 0x1FFF {
+		data = b.cpuRam[addr&0x07FF]
+	} else if addr >= 0x2000 && addr <= 0x3FFF {
+		data = b.ppu.cpuRead(addr&0x0007, readOnly)
+	} else if addr == 0x4015 {
+		data = b.apu.cpuRead(addr, readOnly)
+	} else if addr >= 0x4016 && addr <= 0x4017 {
+		data = b.controllerRead(addr&0x0001, readOnly)
+	}
+	if !readOnly {
+		b.openBus = data
+	}
+	return data
+}
+
+// updateControllers sets what the controllers send from the buttons held.
+// Turbo buttons alternate between pressed and released every turboRate
+// frames, counted by the PPU so that a replay sees the same presses. A
+// movie being played back replaces them all.
+func (b *Bus) updateControllers() {
+	if b.moviePlaying {
+		b.controller = b.movieButtons
+		return
+	}
+	for port := range b.controller {
+		b.controller[port] = b.buttons[port]
+		if (b.ppu.frame/uint64(b.turboRate[port]))%2 == 0 {
+			b.controller[port] |= b.turbo[port]
+		}
+	}
+}
+
+// controllerRead returns the next button of a port in bit 0. Only the low
+// bits are driven by the controller ports, the others keep what was last
+// on the data bus, usually the $40 of the address. Once all eight buttons
+// have been read a standard controller returns 1s.
+func (b *Bus) controllerRead(port uint16, readOnly bool) uint8 {
+	if b.controllerStrobe {
+		b.controllerState[port] = b.controller[port]
+	}
+	data := b.openBus & 0xE0
+	if b.controllerState[port]&0x80 != 0 {
+		data |= 0x01
+	}
+	if !readOnly && !b.controllerStrobe {
+		b.controllerState[port] = b.controllerState[port]<<1 | 0x01
+	}
+	return data
+}
+
+func (b *Bus) insertCartridge(cartridge *Cartridge) {
+	b.cartridge = cartridge
+	b.ppu.connectCartridge(cartridge)
+	b.apu.setTiming(cartridge.info.Timing)
+}
+
+func (b *Bus) reset() {
+	b.cartridge.reset()
+	b.cpu.reset()
+	b.ppu.reset()
+	b.apu.reset()
+	b.systemClockCounter = 0
+	b.dmaDummy = true
+	b.dmaTransfer = false
+	b.dmaData = 0
+	b.dmaPage = 0
+	b.dmaAddr = 0
+	b.dmcStall = 0
+}
+
+// power turns the console off and on: memory is cleared before the reset.
+func (b *Bus) power() {
+	for i := range b.cpuRam {
+		b.cpuRam[i] = 0
+	}
+	b.ppu.clearMemory()
+	b.cartridge.clearRam()
+	b.apu.power()
+	b.controllerState = [2]uint8{}
+	b.controllerStrobe = false
+	b.openBus = 0
+	b.reset()
+}
+
+// SetSampleFrequency starts the audio output at sampleRate Hz, into a new
+// buffer. Zero stops it.
+func (b *Bus) SetSampleFrequency(sampleRate uint32) {
+	b.apu.setSampleRate(float64(sampleRate))
+	b.audio = nil
+	if sampleRate > 0 {
+		b.audio = newAudioBuffer(int(float64(sampleRate) * audioBufferSeconds))
+	}
+}
+
+// pushSample delivers a sample of the APU output to the audio buffer.
+func (b *Bus) pushSample(sample float32) {
+	if b.audio != nil {
+		b.audio.write(sample)
+	}
+}
+
+// controlRate bends the sample rate to bring the audio buffer back to half
+// full, up to maxRateDelta faster when it's rateControlSpan below that and
+// slower when it's as far above. The buffer then neither runs dry nor
+// overflows when the reader's clock drifts from the emulated one, or when
+// frames are paced by a display that isn't quite 60 Hz.
+func (b *Bus) controlRate() {
+	factor := 1.0
+	if b.rateControl && b.audio != nil {
+		offset := (0.5 - b.audio.Fill()) / rateControlSpan
+		factor += maxRateDelta * math.Max(-1, math.Min(1, offset))
+	}
+	b.apu.out.bend(factor)
+}
+
+func (b *Bus) clock() {
+	//cpuDuration := time.Duration(0)
+	//ppuDuration := time.Duration(0)
+
+	if b.trace != nil {
+		b.trace.scanline, b.trace.cycle = b.ppu.scanline, b.ppu.cycle
+	}
+
+	//start := time.Now()
+	b.ppu.clock()
+	//ppuDuration = time.Now().Sub(start)
+
+	if b.systemClockCounter%3 == 0 {
+		// The APU runs off the CPU clock, DMA or not
+		b.apu.clock()
+		if b.dmcStall == 0 && b.apu.dmc.needsSample() {
+			b.dmcStall = dmcStallCycles
+		}
+		if b.dmcStall > 0 {
+			// The DMC takes the bus for its sample byte, which it reads on
+			// the last cycle. OAM DMA waits along with the CPU.
+			b.cpu.cycleCount++
+			b.dmcStall--
+			if b.dmcStall == 0 {
+				b.apu.dmc.load(b.cpuRead(b.apu.dmc.address, false))
+			}
+		} else if b.dmaTransfer {
+			// The CPU is halted, but its cycles keep passing
+			b.cpu.cycleCount++
+			if b.dmaDummy {
+				if b.systemClockCounter%2 == 1 {
+					b.dmaDummy = false
+				}
+			} else {
+				if b.systemClockCounter%2 == 0 {
+					b.dmaData = b.cpuRead((uint16(b.dmaPage)<<8)|uint16(b.dmaAddr), false)
+				} else {
+					pointer := unsafe.Add(b.ppu.oamPtr, uintptr(b.dmaAddr)*unsafe.Sizeof(b.ppu.oam[0].y))
+					value := (*uint8)(pointer)
+					*value = b.dmaData
+					b.dmaAddr++
+
+					if b.dmaAddr == 0x00 {
+						b.dmaTransfer = false
+						b.dmaDummy = true
+					}
+				}
+			}
+		} else {
+			// The interrupt lines are sampled by the CPU at the end of
+			// each of its cycles. IRQ sources stay asserted until the game
+			// acknowledges them, through the mapper or $4015.
+			b.cpu.setNMI(b.ppu.nmi)
+			b.cpu.setIRQ(irqMapper, b.cartridge.irqState())
+			b.cpu.setIRQ(irqFrameCounter, b.apu.frameIRQ)
+			b.cpu.setIRQ(irqDMC, b.apu.dmc.irq)
+			if b.trace != nil && b.cpu.fetchesOpcode() {
+				b.trace.instruction(b.cpu)
+			}
+			//start := time.Now()
+			b.cpu.clock()
+
+			//cpuDuration = time.Now().Sub(start)
+			//fmt.Printf("CPU time = %s\n", elapsed)
+		}
+		b.cartridge.cpuClock()
+	}
+
+	b.systemClockCounter++
+	//return cpuDuration, ppuDuration
+}
+
+func NewBus(cpu *CPU, ppu *PPU, apu *APU) *Bus {
+	bus := &Bus{
+		systemClockCounter: 0,
+		cpuRam:             make([]uint8, 2048),
+		cpu:                cpu,
+		ppu:                ppu,
+		apu:                apu,
+		turboRate:          [2]uint8{defaultTurboRate, defaultTurboRate},
+		dmaDummy:           true,
+		dmaTransfer:        false,
+		dmaAddr:            0,
+		dmaPage:            0,
+		dmaData:            0,
+	}
+	apu.out.emit = bus.pushSample
+	return bus
+}
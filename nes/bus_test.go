@@ -0,0 +1,92 @@
+package nes
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestControllerRead(t *testing.T) {
+	console := newTestConsole(t, []byte{0xEA})
+	bus := console.bus
+	console.SetButtons(0, ButtonA|ButtonStart|ButtonRight)
+	console.SetButtons(1, ButtonB)
+
+	// While the strobe is high both ports keep returning A
+	bus.cpuWrite(0x4016, 0x01)
+	assert.Equal(t, uint8(0x01), bus.cpuRead(0x4016, false)&0x01)
+	assert.Equal(t, uint8(0x01), bus.cpuRead(0x4016, false)&0x01)
+	assert.Equal(t, uint8(0x00), bus.cpuRead(0x4017, false)&0x01)
+
+	// Writes with bit 0 clear don't reload the buttons
+	bus.cpuWrite(0x4016, 0x00)
+	console.SetButtons(0, 0)
+	bus.cpuWrite(0x4016, 0x02)
+	var port0, port1 []uint8
+	for i := 0; i < 10; i++ {
+		port0 = append(port0, bus.cpuRead(0x4016, false)&0x01)
+		port1 = append(port1, bus.cpuRead(0x4017, false)&0x01)
+	}
+	// A, B, Select, Start, Up, Down, Left, Right, then 1s
+	assert.Equal(t, []uint8{1, 0, 0, 1, 0, 0, 0, 1, 1, 1}, port0)
+	assert.Equal(t, []uint8{0, 1, 0, 0, 0, 0, 0, 0, 1, 1}, port1)
+}
+
+func TestControllerOpenBus(t *testing.T) {
+	console := newTestConsole(t, []byte{
+		0xA9, 0x01, // LDA #$01
+		0x8D, 0x16, 0x40, // STA $4016
+		0xA9, 0x00, // LDA #$00
+		0x8D, 0x16, 0x40, // STA $4016
+		0xAD, 0x16, 0x40, // LDA $4016
+		0xAD, 0x17, 0x40, // LDA $4017
+	})
+	console.SetButtons(0, ButtonA)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, console.StepInstruction())
+	}
+	// The upper bits are the high byte of the address, last on the bus
+	assert.Equal(t, uint8(0x41), console.cpu.accumulator)
+	assert.NoError(t, console.StepInstruction())
+	assert.Equal(t, uint8(0x40), console.cpu.accumulator)
+}
+
+func TestTurbo(t *testing.T) {
+	console := newTestConsole(t, []byte{0x4C, 0x00, 0xC0}) // JMP $C000
+	console.SetTurboRate(0, 3)
+	console.SetTurbo(0, ButtonA|ButtonB)
+	console.SetButtons(0, ButtonB|ButtonUp)
+	console.SetTurbo(1, ButtonA)
+
+	var port0, port1 []uint8
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, console.StepFrame())
+		port0 = append(port0, console.bus.controller[0])
+		port1 = append(port1, console.bus.controller[1])
+	}
+	// Frames count from power on, the first StepFrame completes frame 1
+	held := ButtonB | ButtonUp
+	turbo := held | ButtonA
+	assert.Equal(t, []uint8{turbo, turbo, held, held, held, turbo, turbo, turbo}, port0)
+	assert.Equal(t, []uint8{ButtonA, 0, 0, ButtonA, ButtonA, 0, 0, ButtonA}, port1)
+}
+
+func TestCPUCyclesPerFrame(t *testing.T) {
+	// With rendering off every frame is 341 * 262 dots, three frames are
+	// as many CPU cycles
+	console := newTestConsole(t, []byte{0x4C, 0x00, 0xC0}) // JMP $C000
+	assert.NoError(t, console.StepFrame())
+	cycles := console.cpu.cycleCount
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, console.StepFrame())
+	}
+	assert.Equal(t, uint64(341*262), console.cpu.cycleCount-cycles)
+
+	// While rendering, odd frames skip a dot
+	console.bus.cpuWrite(0x2001, 0x08)
+	assert.NoError(t, console.StepFrame())
+	cycles = console.cpu.cycleCount
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, console.StepFrame())
+	}
+	assert.Equal(t, uint64((6*341*262-3)/3), console.cpu.cycleCount-cycles)
+}
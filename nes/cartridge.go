@@ -0,0 +1,306 @@
+package nes
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"nes-emu/mapper"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidHeader    = errors.New("cartridge: not an iNES image")
+	ErrTruncatedTrainer = errors.New("cartridge: truncated trainer")
+	ErrTruncatedPrg     = errors.New("cartridge: truncated PRG ROM")
+	ErrTruncatedChr     = errors.New("cartridge: truncated CHR ROM")
+	ErrInvalidSize      = errors.New("cartridge: invalid ROM size")
+)
+
+// UnsupportedMapperError is returned when the image needs a board that
+// hasn't been registered with mapper.Register.
+type UnsupportedMapperError struct {
+	Mapper    uint16
+	Submapper uint8
+}
+
+func (e *UnsupportedMapperError) Error() string {
+	return fmt.Sprintf("cartridge: unsupported mapper %d.%d", e.Mapper, e.Submapper)
+}
+
+type Cartridge struct {
+	prgBanks  uint8
+	chrBanks  uint8
+	prgMemory []uint8
+	chrMemory []uint8
+	prgRam    []uint8
+	mapper    mapper.Mapper
+	clocker   mapper.CpuClocker
+	mirror    mapper.MIRROR
+	info      CartridgeInfo
+	// hash identifies the image in save states, it's the SHA-256 of PRG
+	// and CHR ROM. Movies use the MD5 of the same data, like FCEUX.
+	hash     [sha256.Size]byte
+	checksum [md5.Size]byte
+
+	savePath    string
+	prgRamDirty bool
+}
+
+func (c *Cartridge) cpuRead(addr uint16, data *uint8) bool {
+	mappedAddr := uint32(0)
+	if c.mapper.CpuMapRead(addr, &mappedAddr) {
+		if mappedAddr == 0xFFFFFFFF {
+			return true
+		}
+		*data = c.prgMemory[mappedAddr]
+		return true
+	}
+	if len(c.prgRam) > 0 && c.mapper.PrgRamMapRead(addr, &mappedAddr) {
+		if mappedAddr == 0xFFFFFFFF {
+			return true
+		}
+		*data = c.prgRam[mappedAddr%uint32(len(c.prgRam))]
+		return true
+	}
+	return false
+}
+
+func (c *Cartridge) cpuWrite(addr uint16, data uint8) bool {
+	mappedAddr := uint32(0)
+	if c.mapper.CpuMapWrite(addr, &mappedAddr, data) {
+		if mappedAddr == 0xFFFFFFFF {
+			return true
+		}
+		c.prgMemory[mappedAddr] = data
+		return true
+	}
+	if len(c.prgRam) > 0 && c.mapper.PrgRamMapWrite(addr, &mappedAddr, data) {
+		if mappedAddr == 0xFFFFFFFF {
+			return true
+		}
+		mappedAddr %= uint32(len(c.prgRam))
+		if c.prgRam[mappedAddr] != data {
+			c.prgRam[mappedAddr] = data
+			c.prgRamDirty = true
+		}
+		return true
+	}
+	return false
+}
+
+func (c *Cartridge) ppuRead(addr uint16, data *uint8) bool {
+	mappedAddr := uint32(0)
+	if c.mapper.PpuMapRead(addr, &mappedAddr) {
+		*data = c.chrMemory[mappedAddr]
+		return true
+	}
+	return false
+}
+
+func (c *Cartridge) ppuWrite(addr uint16, data uint8) bool {
+	mappedAddr := uint32(0)
+	if c.mapper.PpuMapWrite(addr, &mappedAddr, data) {
+		c.chrMemory[mappedAddr] = data
+		return true
+	}
+	return false
+}
+
+func (c *Cartridge) reset() {
+	if c.mapper != nil {
+		c.mapper.Reset()
+	}
+}
+
+// clearRam empties the RAM the board carries, except battery-backed RAM
+// which keeps its content across power cycles.
+func (c *Cartridge) clearRam() {
+	if !c.info.Battery {
+		for i := range c.prgRam {
+			c.prgRam[i] = 0
+		}
+	}
+	if c.info.ChrRomSize == 0 {
+		for i := range c.chrMemory {
+			c.chrMemory[i] = 0
+		}
+	}
+}
+
+func (c *Cartridge) irqState() bool {
+	return c.mapper.IrqState()
+}
+
+func (c *Cartridge) scanline() {
+	c.mapper.Scanline()
+}
+
+// cpuClock tells mappers that follow the CPU clock a cycle has ended.
+func (c *Cartridge) cpuClock() {
+	if c.clocker != nil {
+		c.clocker.CpuClock()
+	}
+}
+
+// Info returns what the image header says about the board.
+func (c *Cartridge) Info() CartridgeInfo {
+	return c.info
+}
+
+func (c *Cartridge) Mirror() mapper.MIRROR {
+	m := c.mapper.Mirror()
+	if m == mapper.HARDWARE {
+		return c.mirror
+	}
+	return m
+}
+
+// loadBattery restores battery-backed PRG-RAM from path and remembers it as
+// the place to save to. A missing file just means a fresh save.
+func (c *Cartridge) loadBattery(path string) error {
+	c.savePath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	copy(c.prgRam, data)
+	return nil
+}
+
+// saveBattery writes battery-backed PRG-RAM back if it changed since the
+// last save.
+func (c *Cartridge) saveBattery() error {
+	if !c.info.Battery || c.savePath == "" || !c.prgRamDirty {
+		return nil
+	}
+	if err := os.WriteFile(c.savePath, c.prgRam, 0644); err != nil {
+		return err
+	}
+	c.prgRamDirty = false
+	return nil
+}
+
+// NewCartridge loads the iNES image stored in filename. If the board has a
+// battery, its PRG-RAM is restored from (and later saved to) a .sav file
+// next to the image.
+func NewCartridge(filename string) (*Cartridge, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cart, err := LoadCartridge(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	if cart.info.Battery {
+		savePath := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".sav"
+		if err := cart.loadBattery(savePath); err != nil {
+			return nil, err
+		}
+	}
+	return cart, nil
+}
+
+// LoadCartridge reads an iNES image from r. Malformed images are reported
+// with one of the Err* values below, wrapped, or with an
+// *UnsupportedMapperError, so callers can tell them apart with errors.Is
+// and errors.As.
+func LoadCartridge(r io.Reader) (*Cartridge, error) {
+	header := Header{}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	if header.Name != [4]byte{'N', 'E', 'S', 0x1A} {
+		return nil, fmt.Errorf("%w: bad magic % x", ErrInvalidHeader, header.Name)
+	}
+	info, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	var trainer []uint8
+	if info.Trainer {
+		trainer = make([]uint8, 512)
+		if _, err := io.ReadFull(r, trainer); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTruncatedTrainer, err)
+		}
+		// The trainer is loaded at $7000, so the board needs the full 8KB
+		// of PRG-RAM even when an NES 2.0 header declares less
+		if ram := info.PrgRamSize + info.PrgNvramSize; ram < 0x2000 {
+			info.PrgRamSize += 0x2000 - ram
+		}
+	}
+
+	cart := &Cartridge{
+		prgBanks: uint8(info.PrgRomSize / 16384),
+		chrBanks: uint8(info.ChrRomSize / 8192),
+		mirror:   info.Mirror,
+		info:     info,
+	}
+
+	factory, ok := mapper.Lookup(info.Mapper, info.Submapper)
+	if !ok {
+		return nil, &UnsupportedMapperError{Mapper: info.Mapper, Submapper: info.Submapper}
+	}
+	cart.mapper = factory(mapper.Board{
+		Mapper:       info.Mapper,
+		Submapper:    info.Submapper,
+		PrgBanks:     cart.prgBanks,
+		ChrBanks:     cart.chrBanks,
+		PrgRamSize:   info.PrgRamSize,
+		PrgNvramSize: info.PrgNvramSize,
+		ChrRamSize:   info.ChrRamSize,
+		ChrNvramSize: info.ChrNvramSize,
+		Mirror:       info.Mirror,
+		Battery:      info.Battery,
+	})
+	cart.clocker, _ = cart.mapper.(mapper.CpuClocker)
+
+	cart.prgMemory = make([]uint8, info.PrgRomSize)
+	if _, err := io.ReadFull(r, cart.prgMemory); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTruncatedPrg, err)
+	}
+
+	if info.ChrRomSize == 0 {
+		// No CHR ROM, the board carries CHR RAM instead. The mappers all
+		// map a full 8KB pattern table, so that's the least it can have
+		chrRamSize := info.ChrRamSize + info.ChrNvramSize
+		if chrRamSize < 8192 {
+			chrRamSize = 8192
+		}
+		cart.chrMemory = make([]uint8, chrRamSize)
+	} else {
+		cart.chrMemory = make([]uint8, info.ChrRomSize)
+		if _, err := io.ReadFull(r, cart.chrMemory); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTruncatedChr, err)
+		}
+	}
+
+	hash := sha256.New()
+	checksum := md5.New()
+	rom := io.MultiWriter(hash, checksum)
+	rom.Write(cart.prgMemory)
+	if info.ChrRomSize != 0 {
+		rom.Write(cart.chrMemory)
+	}
+	copy(cart.hash[:], hash.Sum(nil))
+	copy(cart.checksum[:], checksum.Sum(nil))
+
+	cart.prgRam = make([]uint8, info.PrgRamSize+info.PrgNvramSize)
+	if trainer != nil {
+		// The trainer lives at $7000-$71FF
+		copy(cart.prgRam[0x1000:], trainer)
+	}
+
+	return cart, nil
+}
@@ -0,0 +1,201 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"nes-emu/mapper"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeImage(prgBanks uint8, chrBanks uint8, mapperId uint8) []byte {
+	image := []byte{'N', 'E', 'S', 0x1A, prgBanks, chrBanks, mapperId << 4, mapperId & 0xF0}
+	image = append(image, make([]byte, 8)...)
+	image = append(image, make([]byte, int(prgBanks)*16384+int(chrBanks)*8192)...)
+	return image
+}
+
+func TestLoadCartridge(t *testing.T) {
+	cart, err := LoadCartridge(bytes.NewReader(makeImage(2, 1, 0)))
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), cart.prgBanks)
+	assert.Equal(t, 32768, len(cart.prgMemory))
+	assert.Equal(t, 8192, len(cart.chrMemory))
+
+	cart, err = LoadCartridge(bytes.NewReader(makeImage(8, 0, 2)))
+	assert.NoError(t, err)
+	assert.Equal(t, 8192, len(cart.chrMemory))
+}
+
+func TestLoadCartridgeErrors(t *testing.T) {
+	image := makeImage(1, 1, 0)
+	image[3] = 0x00
+	_, err := LoadCartridge(bytes.NewReader(image))
+	assert.True(t, errors.Is(err, ErrInvalidHeader))
+
+	_, err = LoadCartridge(bytes.NewReader(image[:10]))
+	assert.True(t, errors.Is(err, ErrInvalidHeader))
+
+	image = makeImage(2, 1, 0)
+	_, err = LoadCartridge(bytes.NewReader(image[:16+16384]))
+	assert.True(t, errors.Is(err, ErrTruncatedPrg))
+
+	_, err = LoadCartridge(bytes.NewReader(image[:len(image)-1]))
+	assert.True(t, errors.Is(err, ErrTruncatedChr))
+
+	_, err = LoadCartridge(bytes.NewReader(makeImage(0, 1, 0)))
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+
+	var unsupported *UnsupportedMapperError
+	_, err = LoadCartridge(bytes.NewReader(makeImage(1, 1, 0x45)))
+	assert.True(t, errors.As(err, &unsupported))
+	assert.Equal(t, uint16(0x45), unsupported.Mapper)
+}
+
+func TestLoadCartridgeSmallChrRam(t *testing.T) {
+	// An NES 2.0 NROM header declaring 4KB of CHR-RAM
+	image := makeImage(1, 0, 0)
+	image[7] |= 0x08
+	image[11] = 0x06
+
+	cart, err := LoadCartridge(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, 8192, len(cart.chrMemory))
+	var data uint8
+	assert.True(t, cart.ppuWrite(0x1FFF, 0x5A))
+	assert.True(t, cart.ppuRead(0x1FFF, &data))
+	assert.Equal(t, uint8(0x5A), data)
+}
+
+func TestLoadCartridgeTrainer(t *testing.T) {
+	// An NES 2.0 header with a trainer and no PRG-RAM declared
+	image := makeImage(1, 1, 0)
+	image[6] |= 0x04
+	image[7] |= 0x08
+	trainer := make([]byte, 512)
+	for i := range trainer {
+		trainer[i] = uint8(i)
+	}
+	image = append(image[:16], append(trainer, image[16:]...)...)
+
+	cart, err := LoadCartridge(bytes.NewReader(image))
+	assert.NoError(t, err)
+	assert.Equal(t, 0x2000, len(cart.prgRam))
+	var data uint8
+	assert.True(t, cart.cpuRead(0x7000, &data))
+	assert.Equal(t, uint8(0x00), data)
+	assert.True(t, cart.cpuRead(0x71FF, &data))
+	assert.Equal(t, uint8(0xFF), data)
+}
+
+func TestParseHeaderNES20(t *testing.T) {
+	info, err := parseHeader(Header{
+		Name:         [4]byte{'N', 'E', 'S', 0x1A},
+		PrgRomChunks: 0x20,
+		ChrRomChunks: 0x00,
+		Mapper1:      0x13,
+		Mapper2:      0x08,
+		PrgRamSize:   0x51,
+		TvSystem1:    0x00,
+		TvSystem2:    0x77,
+		ChrRamSize:   0x07,
+		Timing:       0x03,
+		Expansion:    0x01,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, FormatNES20, info.Format)
+	assert.Equal(t, uint16(0x101), info.Mapper)
+	assert.Equal(t, uint8(5), info.Submapper)
+	assert.Equal(t, uint32(512*1024), info.PrgRomSize)
+	assert.Equal(t, uint32(0), info.ChrRomSize)
+	assert.Equal(t, uint32(8192), info.PrgRamSize)
+	assert.Equal(t, uint32(8192), info.PrgNvramSize)
+	assert.Equal(t, uint32(8192), info.ChrRamSize)
+	assert.Equal(t, uint32(0), info.ChrNvramSize)
+	assert.Equal(t, mapper.VERTICAL, info.Mirror)
+	assert.True(t, info.Battery)
+	assert.Equal(t, TimingDendy, info.Timing)
+	assert.Equal(t, uint8(1), info.ExpansionDevice)
+
+	// Exponent-multiplier notation: 2^14 * 3 bytes of PRG ROM
+	info, err = parseHeader(Header{
+		PrgRomChunks: (14 << 2) | 0x01,
+		Mapper2:      0x08,
+		TvSystem1:    0x0F,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(49152), info.PrgRomSize)
+}
+
+func TestParseHeaderINES(t *testing.T) {
+	info, err := parseHeader(Header{PrgRomChunks: 2, Mapper1: 0x10, Mapper2: 0x40, TvSystem1: 0x01})
+	assert.NoError(t, err)
+	assert.Equal(t, FormatINES, info.Format)
+	assert.Equal(t, uint16(0x41), info.Mapper)
+	assert.Equal(t, uint32(8192), info.PrgRamSize)
+	assert.Equal(t, uint32(8192), info.ChrRamSize)
+	assert.Equal(t, TimingPAL, info.Timing)
+
+	// "DiskDude!" style garbage in the tail of the header
+	info, err = parseHeader(Header{PrgRomChunks: 2, Mapper1: 0x10, Mapper2: 0x44, Expansion: '!'})
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(0x01), info.Mapper)
+}
+
+func TestBatteryBackedRam(t *testing.T) {
+	image := makeImage(1, 1, 0)
+	image[6] |= 0x02
+	romPath := filepath.Join(t.TempDir(), "game.nes")
+	assert.NoError(t, os.WriteFile(romPath, image, 0644))
+
+	cart, err := NewCartridge(romPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 8192, len(cart.prgRam))
+	assert.True(t, cart.cpuWrite(0x6123, 0x42))
+	assert.NoError(t, cart.saveBattery())
+
+	cart, err = NewCartridge(romPath)
+	assert.NoError(t, err)
+	data := uint8(0)
+	assert.True(t, cart.cpuRead(0x6123, &data))
+	assert.Equal(t, uint8(0x42), data)
+
+	saved, err := os.ReadFile(strings.TrimSuffix(romPath, ".nes") + ".sav")
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x42), saved[0x0123])
+}
+
+func TestMMC1ConsecutiveWrites(t *testing.T) {
+	image := makeImage(1, 1, 1)
+	copy(image[16:], []byte{
+		0xEE, 0x18, 0x80, // INC $8018, writes $FF then $00
+		0xA9, 0x00, // LDA #$00
+		0x8D, 0x00, 0x80, // STA $8000
+		0xA9, 0x01, // LDA #$01
+		0x8D, 0x00, 0x80, // STA $8000
+		0xA9, 0x00, // LDA #$00
+		0x8D, 0x00, 0x80, // STA $8000
+		0x8D, 0x00, 0x80, // STA $8000
+		0x8D, 0x00, 0x80, // STA $8000
+		0xFF, // $8018
+	})
+	image[16+0x3FFC] = 0x00
+	image[16+0x3FFD] = 0xC0
+	cart, err := LoadCartridge(bytes.NewReader(image))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	console := NewConsole()
+	console.bus.insertCartridge(cart)
+	console.Reset()
+	// The reset sequence, then the program
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, console.StepInstruction())
+	}
+	// Only the first write of INC reaches the shift register, which resets
+	// it. The five stores then load the control register with 2.
+	assert.Equal(t, mapper.VERTICAL, cart.mapper.Mirror())
+}
@@ -0,0 +1,372 @@
+package nes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// nestest.nes and its reference log are not distributed with the
+// emulator yet. Drop them in testdata to run TestNestest, it's the only
+// comparison of the CPU with a trace from another emulator:
+//
+//	nes/testdata/nestest.nes
+//	nes/testdata/nestest.log
+const (
+	nestestRom = "testdata/nestest.nes"
+	nestestLog = "testdata/nestest.log"
+)
+
+// TestNestest runs nestest in automation mode, starting at $C000 without a
+// PPU, and compares our trace with the reference log line by line.
+func TestNestest(t *testing.T) {
+	rom, err := os.ReadFile(nestestRom)
+	if err != nil {
+		t.Skipf("nestest ROM not available: %v", err)
+	}
+	golden, err := os.ReadFile(nestestLog)
+	if err != nil {
+		t.Skipf("nestest log not available: %v", err)
+	}
+	console := runTraceLog(t, rom, golden)
+
+	// The official and unofficial opcode tests store their result codes
+	// here, zero meaning every test passed
+	assert.Equal(t, uint8(0x00), console.bus.cpuRead(0x0002, true), "official opcodes result")
+	assert.Equal(t, uint8(0x00), console.bus.cpuRead(0x0003, true), "unofficial opcodes result")
+}
+
+// traceProgram is run by TestCPUTrace from $C000. It goes through the
+// addressing modes with and without page crossings, the read-modify-write
+// and unofficial opcodes, branches taken across a page, JSR, RTI and BRK,
+// then 60 OAM DMAs to run past the end of the frame.
+var traceProgram = []byte{
+	0xA2, 0x00, // C000 LDX #$00
+	0xA0, 0x10, // C002 LDY #$10
+	0xA9, 0xFF, // C004 LDA #$FF
+	0x85, 0x10, // C006 STA $10
+	0xA9, 0x02, // C008 LDA #$02
+	0x85, 0x11, // C00A STA $11
+	0xA9, 0x55, // C00C LDA #$55
+	0x8D, 0xFF, 0x02, // C00E STA $02FF
+	0x8D, 0x0F, 0x03, // C011 STA $030F
+	0x00, 0xEA, // C014 BRK
+	0xA6, 0x30, // C016 LDX $30
+	0xB1, 0x10, // C018 LDA ($10),Y
+	0xA1, 0x10, // C01A LDA ($10,X)
+	0xBD, 0xF0, 0x02, // C01C LDA $02F0,X
+	0x9D, 0x00, 0x04, // C01F STA $0400,X
+	0xFE, 0x00, 0x04, // C022 INC $0400,X
+	0x1E, 0x00, 0x04, // C025 ASL $0400,X
+	0x7E, 0x00, 0x04, // C028 ROR $0400,X
+	0x1C, 0x00, 0x02, // C02B NOP $0200,X
+	0x87, 0x20, // C02E SAX $20
+	0xC7, 0x20, // C030 DCP $20
+	0xE7, 0x20, // C032 ISB $20
+	0x07, 0x21, // C034 SLO $21
+	0x27, 0x21, // C036 RLA $21
+	0x47, 0x21, // C038 SRE $21
+	0x67, 0x21, // C03A RRA $21
+	0x04, 0x22, // C03C NOP $22
+	0xA7, 0x31, // C03E LAX $31
+	0x20, 0xFA, 0xC0, // C040 JSR $C0FA
+	0x08,       // C043 PHP
+	0x48,       // C044 PHA
+	0x68,       // C045 PLA
+	0x28,       // C046 PLP
+	0x8A,       // C047 TXA
+	0x29, 0x03, // C048 AND #$03
+	0xF0, 0x02, // C04A BEQ $C04E
+	0xEA,       // C04C NOP
+	0xEA,       // C04D NOP
+	0x38,       // C04E SEC
+	0xE9, 0x01, // C04F SBC #$01
+	0x69, 0x40, // C051 ADC #$40
+	0x00, 0xEA, // C053 BRK
+	0xE6, 0x30, // C055 INC $30
+	0xA5, 0x30, // C057 LDA $30
+	0xC9, 0x20, // C059 CMP #$20
+	0xD0, 0xB9, // C05B BNE $C016
+	0xA0, 0x3C, // C05D LDY #$3C
+	0x8D, 0x14, 0x40, // C05F STA $4014
+	0x88,       // C062 DEY
+	0xD0, 0xFA, // C063 BNE $C05F
+	0x4C, 0x65, 0xC0, // C065 JMP $C065
+}
+
+// traceSubroutine is called at $C0FA, it returns through RTI and RTS.
+var traceSubroutine = []byte{
+	0x18,       // C0FA CLC
+	0x90, 0x03, // C0FB BCC $C100
+	0xEA, 0xEA, 0xEA,
+	0xA9, 0xC1, // C100 LDA #$C1
+	0x48,       // C102 PHA
+	0xA9, 0x0A, // C103 LDA #$0A
+	0x48, // C105 PHA
+	0x08, // C106 PHP
+	0x40, // C107 RTI
+	0xEA, 0xEA,
+	0x60, // C10A RTS
+}
+
+// traceLog is a trace of traceProgram recorded from this emulator, so it
+// only catches changes in behaviour, not whether the behaviour is right.
+// Its PPU column is checked against the cycle count on every line, which
+// doesn't depend on the recording.
+const traceLog = "testdata/cputrace.log"
+
+func traceImage() []byte {
+	image := makeImage(1, 1, 0)
+	prg := image[16 : 16+0x4000]
+	copy(prg, traceProgram)
+	copy(prg[0x00FA:], traceSubroutine)
+	prg[0x0120] = 0x40 // C120 RTI, for BRK and NMI
+	copy(prg[0x3FFA:], []byte{0x20, 0xC1, 0x00, 0xC0, 0x20, 0xC1})
+	return image
+}
+
+func TestCPUTrace(t *testing.T) {
+	golden, err := os.ReadFile(traceLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	console := runTraceLog(t, traceImage(), golden)
+	assert.Equal(t, uint16(0xC065), console.cpu.pc)
+}
+
+// runTraceLog starts rom at $C000 with the registers Nintendulator has
+// after the reset sequence, and compares our trace with golden line by
+// line, until the end of golden.
+func runTraceLog(t *testing.T, rom []byte, golden []byte) *Console {
+	cart, err := LoadCartridge(bytes.NewReader(rom))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	console := NewConsole()
+	console.bus.insertCartridge(cart)
+	console.Reset()
+	assert.NoError(t, console.StepInstruction())
+
+	cpu := console.cpu
+	cpu.pc = 0xC000
+	cpu.status = 0x24
+	cpu.stkp = 0xFD
+	cpu.cycleCount = 7
+
+	var trace bytes.Buffer
+	console.SetTrace(&trace)
+	expected := bufio.NewScanner(bytes.NewReader(golden))
+	line := 0
+	for expected.Scan() {
+		line++
+		want := strings.TrimRight(expected.Text(), "\r")
+		if want == "" {
+			continue
+		}
+		if !assertPPUColumn(t, want, line) {
+			t.FailNow()
+		}
+		trace.Reset()
+		stepErr := console.StepInstruction()
+		got := strings.TrimSuffix(trace.String(), "\n")
+		if !assert.Equal(t, want, got, "line %d", line) {
+			t.FailNow()
+		}
+		if stepErr != nil {
+			t.Fatalf("line %d: %v", line, stepErr)
+		}
+	}
+	return console
+}
+
+// assertPPUColumn checks the PPU position of a reference line against its
+// cycle count. With rendering off every frame is 262 lines of 341 dots,
+// and the PPU makes exactly 3 dots per CPU cycle from power up, where
+// both counts start at 0.
+func assertPPUColumn(t *testing.T, line string, number int) bool {
+	var scanline, dot int
+	var cycles uint64
+	columns := line[strings.Index(line, "PPU:"):]
+	if _, err := fmt.Sscanf(columns, "PPU:%d,%d CYC:%d", &scanline, &dot, &cycles); err != nil {
+		return assert.NoError(t, err, "line %d", number)
+	}
+	dots := 3 * cycles
+	return assert.Equal(t, [2]int{int(dots / 341 % 262), int(dots % 341)}, [2]int{scanline, dot}, "line %d: PPU position at CYC:%d", number, cycles)
+}
+
+// ramBus is 64KB of flat RAM that records every bus access the CPU makes.
+// Reads with readOnly set come from tools, not the CPU, and aren't
+// recorded.
+type ramBus struct {
+	ram    [0x10000]uint8
+	cycles []busCycle
+}
+
+type busCycle struct {
+	addr  uint16
+	data  uint8
+	write bool
+}
+
+func (b *ramBus) cpuRead(addr uint16, readOnly bool) uint8 {
+	if !readOnly {
+		b.cycles = append(b.cycles, busCycle{addr: addr, data: b.ram[addr]})
+	}
+	return b.ram[addr]
+}
+
+func (b *ramBus) cpuWrite(addr uint16, data uint8) {
+	b.cycles = append(b.cycles, busCycle{addr: addr, data: data, write: true})
+	b.ram[addr] = data
+}
+
+// singleStepDir is where the per-opcode test vectors are read from, one
+// file per opcode named 00.json to ff.json. The nes6502 set of
+// github.com/SingleStepTests/65x02 is used when it's there. Otherwise a
+// handful of vectors written by hand in the same format run instead: page
+// crossings, dummy reads and writes, stack and branch timing. They aren't
+// from the real chip, only from the documented cycle-by-cycle behaviour.
+func singleStepDir() string {
+	if dir := os.Getenv("NES_SINGLESTEP_TESTS"); dir != "" {
+		return dir
+	}
+	if _, err := os.Stat(filepath.Join("testdata", "nes6502")); err == nil {
+		return filepath.Join("testdata", "nes6502")
+	}
+	return filepath.Join("testdata", "singlestep-handwritten")
+}
+
+type singleStepState struct {
+	PC  uint16      `json:"pc"`
+	S   uint8       `json:"s"`
+	A   uint8       `json:"a"`
+	X   uint8       `json:"x"`
+	Y   uint8       `json:"y"`
+	P   uint8       `json:"p"`
+	RAM [][2]uint32 `json:"ram"`
+}
+
+type singleStepTest struct {
+	Name    string           `json:"name"`
+	Initial singleStepState  `json:"initial"`
+	Final   singleStepState  `json:"final"`
+	Cycles  [][3]interface{} `json:"cycles"`
+}
+
+// singleStepSkipped are the opcodes whose result depends on analog effects
+// of the chip (XAA and LXA) or that never complete (JAM).
+var singleStepSkipped = map[uint8]bool{
+	0x8B: true, 0xAB: true,
+	0x02: true, 0x12: true, 0x22: true, 0x32: true, 0x42: true, 0x52: true,
+	0x62: true, 0x72: true, 0x92: true, 0xB2: true, 0xD2: true, 0xF2: true,
+}
+
+// TestSingleStep runs the per-opcode test vectors. Each vector is a single
+// instruction from a known CPU and memory state; the final state has to
+// match, and so does every bus access, dummy ones included, cycle by cycle.
+// With -short only the first 100 vectors of each opcode are run.
+func TestSingleStep(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join(singleStepDir(), "*.json"))
+	if len(files) == 0 {
+		t.Fatalf("no single step test vectors in %s", singleStepDir())
+	}
+
+	for _, file := range files {
+		file := file
+		var opcode uint8
+		if _, err := fmt.Sscanf(filepath.Base(file), "%02x.json", &opcode); err != nil {
+			continue
+		}
+		t.Run(fmt.Sprintf("%02x", opcode), func(t *testing.T) {
+			if singleStepSkipped[opcode] {
+				t.Skip("unstable or jamming opcode")
+			}
+			data, err := os.ReadFile(file)
+			if !assert.NoError(t, err) {
+				return
+			}
+			var tests []singleStepTest
+			if !assert.NoError(t, json.Unmarshal(data, &tests)) {
+				return
+			}
+			if testing.Short() && len(tests) > 100 {
+				tests = tests[:100]
+			}
+			for _, test := range tests {
+				if !runSingleStep(t, test) {
+					return
+				}
+			}
+		})
+	}
+}
+
+func runSingleStep(t *testing.T, test singleStepTest) bool {
+	bus := &ramBus{}
+	for _, cell := range test.Initial.RAM {
+		bus.ram[cell[0]] = uint8(cell[1])
+	}
+	cpu := NewCPU()
+	cpu.connectBus(bus)
+	cpu.pc = test.Initial.PC
+	cpu.stkp = test.Initial.S
+	cpu.accumulator = test.Initial.A
+	cpu.xRegister = test.Initial.X
+	cpu.yRegister = test.Initial.Y
+	cpu.status = test.Initial.P
+
+	cycles := stepCPU(cpu)
+
+	ok := assert.Equal(t, test.Final.PC, cpu.pc, "%s: PC", test.Name) &&
+		assert.Equal(t, test.Final.S, cpu.stkp, "%s: S", test.Name) &&
+		assert.Equal(t, test.Final.A, cpu.accumulator, "%s: A", test.Name) &&
+		assert.Equal(t, test.Final.X, cpu.xRegister, "%s: X", test.Name) &&
+		assert.Equal(t, test.Final.Y, cpu.yRegister, "%s: Y", test.Name) &&
+		// B isn't a real flag, it only exists in copies pushed to the stack
+		assert.Equal(t, test.Final.P&^uint8(B), cpu.status&^uint8(B), "%s: P", test.Name)
+	for _, cell := range test.Final.RAM {
+		ok = ok && assert.Equal(t, uint8(cell[1]), bus.ram[cell[0]], "%s: RAM $%04X", test.Name, cell[0])
+	}
+	if !ok || !assert.Equal(t, len(test.Cycles), cycles, "%s: cycles", test.Name) {
+		return false
+	}
+
+	// Every cycle makes exactly one bus access, the same as the reference
+	if !assert.Equal(t, len(test.Cycles), len(bus.cycles), "%s: bus accesses", test.Name) {
+		return false
+	}
+	for i, cycle := range test.Cycles {
+		addr, _ := cycle[0].(float64)
+		data, _ := cycle[1].(float64)
+		kind, _ := cycle[2].(string)
+		want := busCycle{addr: uint16(addr), data: uint8(data), write: kind == "write"}
+		if !assert.Equal(t, want, bus.cycles[i], "%s: bus cycle %d", test.Name, i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestInstructionTableCoverage makes sure every operation and addressing
+// mode is reachable from the opcode table, so none of them is dead code.
+// It doesn't look at which opcodes the test vectors cover.
+func TestInstructionTableCoverage(t *testing.T) {
+	operations := make(map[string]bool)
+	modes := make(map[string]bool)
+	for _, instruction := range loadInstructions() {
+		operations[instruction.Name] = true
+		modes[instruction.AddrMode] = true
+	}
+	for name := range Operations {
+		assert.True(t, operations[name], "operation %s isn't used by any opcode", name)
+	}
+	for name := range AddressModes {
+		assert.True(t, modes[name], "addressing mode %s isn't used by any opcode", name)
+	}
+}
@@ -0,0 +1,240 @@
+package nes
+
+import (
+	"image"
+	"io"
+)
+
+// Controller button masks, as shifted out of $4016/$4017 (A first).
+const (
+	ButtonA      = uint8(0x80)
+	ButtonB      = uint8(0x40)
+	ButtonSelect = uint8(0x20)
+	ButtonStart  = uint8(0x10)
+	ButtonUp     = uint8(0x08)
+	ButtonDown   = uint8(0x04)
+	ButtonLeft   = uint8(0x02)
+	ButtonRight  = uint8(0x01)
+)
+
+// defaultTurboRate is how many frames turbo buttons stay pressed, then
+// released: 15 presses per second.
+const defaultTurboRate = 2
+
+// batteryFlushFrames is how often, in frames, battery-backed RAM that
+// changed is written back to disk (about ten seconds).
+const batteryFlushFrames = 600
+
+// Console is a complete NES with no dependency on a window or an audio
+// device. Frontends drive it one frame (or one instruction) at a time and
+// pull the picture and the samples out of it.
+type Console struct {
+	bus *Bus
+	cpu *CPU
+	ppu *PPU
+	apu *APU
+
+	frameCount uint64
+
+	// Movie being recorded or played back, see movie.go
+	movie         *Movie
+	movieMode     movieMode
+	movieReadOnly bool
+	movieCommands uint8
+}
+
+func NewConsole() *Console {
+	cpu := NewCPU()
+	ppu := NewPPU()
+	apu := NewAPU()
+	bus := NewBus(cpu, ppu, apu)
+	cpu.connectBus(bus)
+	return &Console{
+		bus: bus,
+		cpu: cpu,
+		ppu: ppu,
+		apu: apu,
+	}
+}
+
+// LoadROM inserts the cartridge stored in filename and resets the console.
+func (c *Console) LoadROM(filename string) error {
+	cart, err := NewCartridge(filename)
+	if err != nil {
+		return err
+	}
+	if err := c.SaveBattery(); err != nil {
+		return err
+	}
+	c.StopMovie()
+	c.bus.insertCartridge(cart)
+	c.Reset()
+	return nil
+}
+
+// CartridgeInfo describes the loaded cartridge.
+func (c *Console) CartridgeInfo() CartridgeInfo {
+	return c.bus.cartridge.Info()
+}
+
+// Reset presses the console's reset button. A cartridge must be loaded.
+// While a movie is recorded the reset happens at the start of the next
+// frame, and while one is played back it's ignored.
+func (c *Console) Reset() {
+	switch c.movieMode {
+	case movieRecording:
+		c.movieCommands |= MovieSoftReset
+	case movieOff:
+		c.bus.reset()
+	}
+}
+
+// Power turns the console off and on again: RAM is cleared, except
+// battery-backed RAM. Movies treat it like Reset.
+func (c *Console) Power() {
+	switch c.movieMode {
+	case movieRecording:
+		c.movieCommands |= MovieHardReset
+	case movieOff:
+		c.bus.power()
+	}
+}
+
+// StepInstruction runs the system until the CPU has completed one whole
+// instruction. The PPU and APU advance by the same amount of time. Once the
+// CPU has jammed it returns a *JamError without running anything.
+func (c *Console) StepInstruction() error {
+	for c.cpu.isComplete() {
+		if c.cpu.jammed {
+			return c.jamError()
+		}
+		c.bus.clock()
+	}
+	for !c.cpu.isComplete() {
+		c.bus.clock()
+	}
+	if c.cpu.jammed {
+		return c.jamError()
+	}
+	return nil
+}
+
+// StepFrame runs the system until the PPU has finished the current frame.
+// The PPU and APU keep running when the CPU jams, like they do on the real
+// console, and StepFrame reports it with a *JamError.
+func (c *Console) StepFrame() error {
+	c.movieFrame()
+	for !c.ppu.frameComplete {
+		c.bus.clock()
+	}
+	c.ppu.frameComplete = false
+	c.bus.updateControllers()
+	c.bus.controlRate()
+
+	c.frameCount++
+	if c.frameCount%batteryFlushFrames == 0 {
+		// Errors are reported again by the next SaveBattery or Close, the
+		// RAM stays marked as changed until it's written successfully
+		_ = c.SaveBattery()
+	}
+	if c.cpu.jammed {
+		return c.jamError()
+	}
+	return nil
+}
+
+func (c *Console) jamError() error {
+	return &JamError{Opcode: c.cpu.opcode, Address: c.cpu.pc}
+}
+
+// SetTrace makes the console write a line to w for every instruction the
+// CPU executes, in the format of nestest.log. A nil w turns tracing off.
+// Tracing is slow, w should be buffered.
+func (c *Console) SetTrace(w io.Writer) {
+	if w == nil {
+		c.bus.trace = nil
+		return
+	}
+	c.bus.trace = &tracer{w: w}
+}
+
+// SaveBattery writes the cartridge's battery-backed RAM to its .sav file
+// if it changed since the last save.
+func (c *Console) SaveBattery() error {
+	if c.bus.cartridge == nil {
+		return nil
+	}
+	return c.bus.cartridge.saveBattery()
+}
+
+// Close saves battery-backed RAM. It should be called before exiting.
+func (c *Console) Close() error {
+	return c.SaveBattery()
+}
+
+// SetPalette replaces the built-in palette with the one in filename, see
+// LoadPalette for the formats understood.
+func (c *Console) SetPalette(filename string) error {
+	palette, err := LoadPalette(filename)
+	if err != nil {
+		return err
+	}
+	c.ppu.palScreen = palette
+	return nil
+}
+
+// FrameBuffer returns the last completed frame, 256x240 pixels. The image
+// is reused and overwritten at the end of every frame.
+func (c *Console) FrameBuffer() *image.RGBA {
+	return c.ppu.screenImage
+}
+
+// SetSampleFrequency sets the rate, in Hz, at which audio samples are
+// produced into AudioBuffer. It replaces the buffer, 0 turning the audio
+// off.
+func (c *Console) SetSampleFrequency(sampleRate uint32) {
+	c.bus.SetSampleFrequency(sampleRate)
+}
+
+// AudioBuffer returns the buffer the APU output is written to, nil while
+// the audio is off. Samples are dropped when it's full.
+func (c *Console) AudioBuffer() *AudioBuffer {
+	return c.bus.audio
+}
+
+// SetRateControl lets the sample rate bend slightly after each frame to
+// keep AudioBuffer half full, for frontends whose audio device and frame
+// pacing run on different clocks. It's off by default so that the output
+// is exact.
+func (c *Console) SetRateControl(enable bool) {
+	c.bus.rateControl = enable
+	c.bus.controlRate()
+}
+
+// SetButtons sets the buttons held on controller port 0 or 1, as a mask of
+// the Button constants.
+func (c *Console) SetButtons(port int, mask uint8) {
+	c.bus.buttons[port&0x01] = mask
+	c.bus.updateControllers()
+}
+
+// SetTurbo sets the turbo buttons held on a port. They repeatedly press
+// and release the buttons in mask, at the rate given to SetTurboRate,
+// while the same buttons held through SetButtons stay pressed. The rate
+// follows emulated frames, not wall time, so recordings replay the same.
+func (c *Console) SetTurbo(port int, mask uint8) {
+	c.bus.turbo[port&0x01] = mask
+	c.bus.updateControllers()
+}
+
+// SetTurboRate sets how many frames turbo buttons of a port stay pressed,
+// then released. It's clamped to 1-255.
+func (c *Console) SetTurboRate(port int, frames int) {
+	if frames < 1 {
+		frames = 1
+	} else if frames > 255 {
+		frames = 255
+	}
+	c.bus.turboRate[port&0x01] = uint8(frames)
+	c.bus.updateControllers()
+}
@@ -0,0 +1,1361 @@
+package nes
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+type Instruction struct {
+	Name     string `json:"name"`
+	AddrMode string `json:"addr_mode"`
+	Cycles   uint8  `json:"cycles"`
+	Illegal  bool   `json:"illegal,omitempty"`
+}
+
+// cpuBus is what the CPU sees of the system: the 16 bit address space. The
+// console's Bus is the real one, tests give the CPU flat RAM.
+type cpuBus interface {
+	cpuRead(addr uint16, readOnly bool) uint8
+	cpuWrite(addr uint16, data uint8)
+}
+
+// The CPU runs one cycle per clock and makes exactly one bus access in each,
+// like the real 6502, dummy reads and writes included. step counts the
+// cycles of the current instruction, 1 being the opcode fetch, and is 0
+// between instructions.
+type CPU struct {
+	accumulator uint8
+	xRegister   uint8
+	yRegister   uint8
+	stkp        uint8
+	pc          uint16
+	status      uint8
+
+	fetched        uint8
+	addrAbs        uint16
+	addrRel        uint16
+	previousOpcode uint8
+	previousPc     uint16
+	opcode         uint8
+	jammed         bool
+	cycleCount     uint64
+
+	step         uint8
+	addressed    bool
+	operandRead  bool
+	operandCycle uint8
+	interrupt    interruptKind
+
+	// Interrupt lines. NMI is edge triggered: needNmi latches a rising edge
+	// of nmiLine until the NMI is taken. IRQ is level triggered, asserted
+	// while any source in irqLines is. Both are sampled at the end of every
+	// cycle, and an instruction boundary acts on what was sampled at the end
+	// of the instruction's second to last cycle (prevNeedNmi, prevRunIrq).
+	nmiLine     bool
+	nmiPrevLine bool
+	needNmi     bool
+	prevNeedNmi bool
+	irqLines    uint8
+	runIrq      bool
+	prevRunIrq  bool
+
+	bus   cpuBus
+	table [256]opcodeEntry
+}
+
+// addressingMode is the compiled form of Instruction.AddrMode, so the hot
+// path compares small integers instead of strings.
+type addressingMode uint8
+
+const (
+	modeIMP addressingMode = iota
+	modeIMM
+	modeZP0
+	modeZPX
+	modeZPY
+	modeREL
+	modeABS
+	modeABX
+	modeABY
+	modeIND
+	modeIZX
+	modeIZY
+)
+
+var addressingModes = map[string]addressingMode{
+	"IMP": modeIMP,
+	"IMM": modeIMM,
+	"ZP0": modeZP0,
+	"ZPX": modeZPX,
+	"ZPY": modeZPY,
+	"REL": modeREL,
+	"ABS": modeABS,
+	"ABX": modeABX,
+	"ABY": modeABY,
+	"IND": modeIND,
+	"IZX": modeIZX,
+	"IZY": modeIZY,
+}
+
+// interruptKind tells which interrupt sequence the CPU is running, if any.
+// BRK runs the same sequence as an instruction. Which vector IRQ and BRK
+// end up using is only decided when P is pushed: an NMI detected by then
+// hijacks the sequence.
+type interruptKind uint8
+
+const (
+	interruptNone interruptKind = iota
+	interruptIRQ
+	interruptNMI
+	interruptReset
+	interruptBRK
+)
+
+// IRQ sources, the IRQ line is asserted while any of them is.
+const (
+	irqMapper       = uint8(1 << 0)
+	irqFrameCounter = uint8(1 << 1)
+	irqDMC          = uint8(1 << 2)
+)
+
+// opcodeEntry is one row of the instruction table with the operation and
+// the addressing mode already resolved to functions.
+type opcodeEntry struct {
+	name     string
+	run      func(*CPU)
+	access   accessKind
+	addrMode func(*CPU) bool
+	mode     addressingMode
+	cycles   uint8
+	illegal  bool
+}
+
+// compileInstructions resolves the names in the instruction lookup into a
+// table indexed by opcode. Unknown names are a bug in the lookup table.
+func compileInstructions(lookup []Instruction) [256]opcodeEntry {
+	var table [256]opcodeEntry
+	if len(lookup) != len(table) {
+		panic(fmt.Sprintf("instruction lookup has %d entries, want 256", len(lookup)))
+	}
+	for i, instruction := range lookup {
+		operation, ok := Operations[instruction.Name]
+		if !ok {
+			panic("unknown operation " + instruction.Name)
+		}
+		addrMode, ok := AddressModes[instruction.AddrMode]
+		if !ok {
+			panic("unknown addressing mode " + instruction.AddrMode)
+		}
+		table[i] = opcodeEntry{
+			name:     instruction.Name,
+			run:      operation.run,
+			access:   operation.access,
+			addrMode: addrMode,
+			mode:     addressingModes[instruction.AddrMode],
+			cycles:   instruction.Cycles,
+			illegal:  instruction.Illegal,
+		}
+	}
+	return table
+}
+
+// AddressModes run one cycle per call, starting with the cycle after the
+// opcode fetch, and make at most one bus access. They return true once
+// addrAbs holds the effective address. IMP and IMM need no cycle of their
+// own.
+var AddressModes = map[string]func(*CPU) bool{
+	"IMP": IMP,
+	"IMM": IMM,
+	"ZP0": ZP0,
+	"ZPX": ZPX,
+	"ZPY": ZPY,
+	"REL": REL,
+	"ABS": ABS,
+	"ABX": ABX,
+	"ABY": ABY,
+	"IND": IND,
+	"IZX": IZX,
+	"IZY": IZY,
+}
+
+func IMP(c *CPU) bool {
+	return true
+}
+
+func IMM(c *CPU) bool {
+	c.addrAbs = c.pc
+	c.pc++
+	return true
+}
+
+func ZP0(c *CPU) bool {
+	c.addrAbs = uint16(c.read(c.pc))
+	c.pc++
+	return true
+}
+
+func ZPX(c *CPU) bool {
+	return c.zeroPageIndexed(c.xRegister)
+}
+
+func ZPY(c *CPU) bool {
+	return c.zeroPageIndexed(c.yRegister)
+}
+
+// zeroPageIndexed reads the base address, then reads from it while the
+// index is added. The sum wraps around in the zero page.
+func (c *CPU) zeroPageIndexed(index uint8) bool {
+	if c.step == 2 {
+		c.addrAbs = uint16(c.read(c.pc))
+		c.pc++
+		return false
+	}
+	c.read(c.addrAbs)
+	c.addrAbs = uint16(uint8(c.addrAbs) + index)
+	return true
+}
+
+func REL(c *CPU) bool {
+	c.addrRel = uint16(c.read(c.pc))
+	c.pc++
+	if c.addrRel&0x80 != 0 {
+		c.addrRel |= 0xFF00
+	}
+	return true
+}
+
+func ABS(c *CPU) bool {
+	if c.step == 2 {
+		c.addrAbs = uint16(c.read(c.pc))
+		c.pc++
+		return false
+	}
+	c.addrAbs |= uint16(c.read(c.pc)) << 8
+	c.pc++
+	return true
+}
+
+func ABX(c *CPU) bool {
+	return c.absoluteIndexed(c.xRegister)
+}
+
+func ABY(c *CPU) bool {
+	return c.absoluteIndexed(c.yRegister)
+}
+
+func (c *CPU) absoluteIndexed(index uint8) bool {
+	if c.step < 4 {
+		ABS(c)
+		return false
+	}
+	c.indexedRead(index)
+	return true
+}
+
+// indexedRead is the last cycle of the indexed modes. The CPU adds the
+// index to the low byte first and reads from there while it fixes the high
+// byte. For reads that don't cross a page that's the operand already, and
+// operandRead is set; otherwise the read is a dummy one.
+func (c *CPU) indexedRead(index uint8) {
+	target := c.addrAbs + uint16(index)
+	unfixed := (c.addrAbs & 0xFF00) | (target & 0x00FF)
+	c.fetched = c.read(unfixed)
+	c.addrAbs = target
+	c.operandRead = unfixed == target
+}
+
+func IND(c *CPU) bool {
+	switch c.step {
+	case 2, 3:
+		ABS(c)
+		return false
+	case 4:
+		c.fetched = c.read(c.addrAbs)
+		return false
+	}
+	// The pointer's high byte doesn't carry into the next page
+	hi := c.read((c.addrAbs & 0xFF00) | uint16(uint8(c.addrAbs)+1))
+	c.addrAbs = (uint16(hi) << 8) | uint16(c.fetched)
+	return true
+}
+
+func IZX(c *CPU) bool {
+	switch c.step {
+	case 2:
+		c.addrAbs = uint16(c.read(c.pc))
+		c.pc++
+	case 3:
+		c.read(c.addrAbs)
+		c.addrAbs = uint16(uint8(c.addrAbs) + c.xRegister)
+	case 4:
+		c.fetched = c.read(c.addrAbs)
+	default:
+		hi := c.read(uint16(uint8(c.addrAbs) + 1))
+		c.addrAbs = (uint16(hi) << 8) | uint16(c.fetched)
+		return true
+	}
+	return false
+}
+
+func IZY(c *CPU) bool {
+	switch c.step {
+	case 2:
+		c.addrAbs = uint16(c.read(c.pc))
+		c.pc++
+	case 3:
+		c.fetched = c.read(c.addrAbs)
+	case 4:
+		hi := c.read(uint16(uint8(c.addrAbs) + 1))
+		c.addrAbs = (uint16(hi) << 8) | uint16(c.fetched)
+	default:
+		c.indexedRead(c.yRegister)
+		return true
+	}
+	return false
+}
+
+// accessKind is what an operation does at the effective address, which
+// decides the bus cycles that follow addressing.
+type accessKind uint8
+
+const (
+	accessNone   accessKind = iota // implied, registers only
+	accessRead                     // reads the operand into fetched
+	accessWrite                    // writes fetched
+	accessModify                   // reads, writes the old value back, then the new one
+	accessCustom                   // runs all of its cycles itself
+)
+
+// Operation is what an instruction does. Apart from the custom ones,
+// operations never touch the bus: the CPU reads the operand into fetched
+// before running them and writes fetched back after.
+type Operation struct {
+	access accessKind
+	run    func(*CPU)
+}
+
+var Operations = map[string]Operation{
+	"ADC": {accessRead, ADC},
+	"SBC": {accessRead, SBC},
+	"AND": {accessRead, AND},
+	"ASL": {accessModify, ASL},
+	"BCC": {accessCustom, BCC},
+	"BCS": {accessCustom, BCS},
+	"BEQ": {accessCustom, BEQ},
+	"BIT": {accessRead, BIT},
+	"BMI": {accessCustom, BMI},
+	"BNE": {accessCustom, BNE},
+	"BPL": {accessCustom, BPL},
+	"BRK": {accessCustom, BRK},
+	"BVC": {accessCustom, BVC},
+	"BVS": {accessCustom, BVS},
+	"CLC": {accessNone, CLC},
+	"CLD": {accessNone, CLD},
+	"CLI": {accessNone, CLI},
+	"CLV": {accessNone, CLV},
+	"CMP": {accessRead, CMP},
+	"CPX": {accessRead, CPX},
+	"CPY": {accessRead, CPY},
+	"DEC": {accessModify, DEC},
+	"DEX": {accessNone, DEX},
+	"DEY": {accessNone, DEY},
+	"EOR": {accessRead, EOR},
+	"INC": {accessModify, INC},
+	"INX": {accessNone, INX},
+	"INY": {accessNone, INY},
+	"JMP": {accessCustom, JMP},
+	"JSR": {accessCustom, JSR},
+	"LDA": {accessRead, LDA},
+	"LDX": {accessRead, LDX},
+	"LDY": {accessRead, LDY},
+	"LSR": {accessModify, LSR},
+	"NOP": {accessRead, NOP},
+	"ORA": {accessRead, ORA},
+	"PHA": {accessCustom, PHA},
+	"PHP": {accessCustom, PHP},
+	"PLA": {accessCustom, PLA},
+	"PLP": {accessCustom, PLP},
+	"ROL": {accessModify, ROL},
+	"ROR": {accessModify, ROR},
+	"RTI": {accessCustom, RTI},
+	"RTS": {accessCustom, RTS},
+	"SEC": {accessNone, SEC},
+	"SED": {accessNone, SED},
+	"SEI": {accessNone, SEI},
+	"STA": {accessWrite, STA},
+	"STX": {accessWrite, STX},
+	"STY": {accessWrite, STY},
+	"TAX": {accessNone, TAX},
+	"TAY": {accessNone, TAY},
+	"TSX": {accessNone, TSX},
+	"TXA": {accessNone, TXA},
+	"TXS": {accessNone, TXS},
+	"TYA": {accessNone, TYA},
+	"XXX": {accessRead, XXX},
+
+	// Unofficial opcodes
+	"ALR": {accessRead, ALR},
+	"ANC": {accessRead, ANC},
+	"ARR": {accessRead, ARR},
+	"AXS": {accessRead, AXS},
+	"DCP": {accessModify, DCP},
+	"ISC": {accessModify, ISC},
+	"JAM": {accessCustom, JAM},
+	"LAS": {accessRead, LAS},
+	"LAX": {accessRead, LAX},
+	"RLA": {accessModify, RLA},
+	"RRA": {accessModify, RRA},
+	"SAX": {accessWrite, SAX},
+	"SHA": {accessWrite, SHA},
+	"SHX": {accessWrite, SHX},
+	"SHY": {accessWrite, SHY},
+	"SLO": {accessModify, SLO},
+	"SRE": {accessModify, SRE},
+	"TAS": {accessWrite, TAS},
+}
+
+// addWithCarry is the adder behind ADC and SBC, subtraction being the
+// addition of the inverted operand.
+func (c *CPU) addWithCarry(value uint8) {
+	temp := uint16(c.accumulator) + uint16(value) + uint16(c.getFlag(C))
+	c.setFlag(C, temp > 255)
+	c.setFlag(Z, (temp&0x00FF) == 0)
+	overflow := ((^(uint16(c.accumulator) ^ uint16(value))) & (uint16(c.accumulator) ^ temp)) & 0x0080
+	c.setFlag(V, overflow != 0)
+	c.setFlag(N, (temp&0x80) != 0)
+	c.accumulator = uint8(temp & 0x00FF)
+}
+
+func ADC(c *CPU) {
+	c.addWithCarry(c.fetched)
+}
+
+func SBC(c *CPU) {
+	c.addWithCarry(c.fetched ^ 0xFF)
+}
+
+func AND(c *CPU) {
+	c.accumulator = c.accumulator & c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, c.accumulator&0x80 != 0)
+}
+
+func ASL(c *CPU) {
+	c.setFlag(C, (c.fetched&0x80) != 0)
+	c.fetched <<= 1
+	c.setFlag(Z, c.fetched == 0x00)
+	c.setFlag(N, c.fetched&0x80 != 0)
+}
+
+// branch fetches the offset and, when the branch is taken, spends one more
+// cycle adding it to the low byte of PC and another one fixing the high
+// byte if a page was crossed. Both extra cycles read the opcode the CPU
+// would run next.
+func (c *CPU) branch(taken bool) {
+	switch c.step {
+	case 2:
+		REL(c)
+		if !taken {
+			c.finish()
+		}
+	case 3:
+		c.addrAbs = c.pc + c.addrRel
+		if (c.addrAbs & 0xFF00) == (c.pc & 0xFF00) {
+			// Without a page crossing the branch doesn't poll interrupts
+			// again: an IRQ that showed up during the offset fetch waits
+			// for the end of the next instruction
+			if c.runIrq && !c.prevRunIrq {
+				c.runIrq = false
+			}
+			c.read(c.pc)
+			c.pc = c.addrAbs
+			c.finish()
+			return
+		}
+		c.read(c.pc)
+		c.pc = (c.pc & 0xFF00) | (c.addrAbs & 0x00FF)
+	default:
+		c.read(c.pc)
+		c.pc = c.addrAbs
+		c.finish()
+	}
+}
+
+func BCC(c *CPU) {
+	c.branch(c.getFlag(C) == 0)
+}
+
+func BCS(c *CPU) {
+	c.branch(c.getFlag(C) == 1)
+}
+
+func BEQ(c *CPU) {
+	c.branch(c.getFlag(Z) == 1)
+}
+
+func BIT(c *CPU) {
+	temp := c.accumulator & c.fetched
+	c.setFlag(Z, (temp&0x00FF) == 0x00)
+	c.setFlag(N, (c.fetched&(1<<7)) != 0)
+	c.setFlag(V, (c.fetched&(1<<6)) != 0)
+}
+
+func BMI(c *CPU) {
+	c.branch(c.getFlag(N) == 1)
+}
+
+func BNE(c *CPU) {
+	c.branch(c.getFlag(Z) == 0)
+}
+
+func BPL(c *CPU) {
+	c.branch(c.getFlag(N) == 0)
+}
+
+func BRK(c *CPU) {
+	c.interruptSequence(interruptBRK)
+}
+
+func BVC(c *CPU) {
+	c.branch(c.getFlag(V) == 0)
+}
+
+func BVS(c *CPU) {
+	c.branch(c.getFlag(V) == 1)
+}
+
+func CLC(c *CPU) {
+	c.setFlag(C, false)
+}
+
+func CLD(c *CPU) {
+	c.setFlag(D, false)
+}
+
+func CLI(c *CPU) {
+	c.setFlag(I, false)
+}
+
+func CLV(c *CPU) {
+	c.setFlag(V, false)
+}
+
+func CMP(c *CPU) {
+	temp := uint16(c.accumulator) - uint16(c.fetched)
+	c.setFlag(C, c.accumulator >= c.fetched)
+	c.setFlag(Z, (temp&0x00FF) == 0x0000)
+	c.setFlag(N, (temp&0x0080) != 0)
+}
+
+func CPX(c *CPU) {
+	temp := uint16(c.xRegister) - uint16(c.fetched)
+	c.setFlag(C, c.xRegister >= c.fetched)
+	c.setFlag(Z, (temp&0x00FF) == 0x0000)
+	c.setFlag(N, (temp&0x0080) != 0)
+}
+
+func CPY(c *CPU) {
+	temp := uint16(c.yRegister) - uint16(c.fetched)
+	c.setFlag(C, c.yRegister >= c.fetched)
+	c.setFlag(Z, (temp&0x00FF) == 0x0000)
+	c.setFlag(N, (temp&0x0080) != 0)
+}
+
+func DEC(c *CPU) {
+	c.fetched--
+	c.setFlag(Z, c.fetched == 0x00)
+	c.setFlag(N, (c.fetched&0x80) != 0)
+}
+
+func DEX(c *CPU) {
+	c.xRegister--
+	c.setFlag(Z, c.xRegister == 0x00)
+	c.setFlag(N, (c.xRegister&0x80) != 0)
+}
+
+func DEY(c *CPU) {
+	c.yRegister--
+	c.setFlag(Z, c.yRegister == 0x00)
+	c.setFlag(N, (c.yRegister&0x80) != 0)
+}
+
+func EOR(c *CPU) {
+	c.accumulator = c.accumulator ^ c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func INC(c *CPU) {
+	c.fetched++
+	c.setFlag(Z, c.fetched == 0x00)
+	c.setFlag(N, (c.fetched&0x80) != 0)
+}
+
+func INX(c *CPU) {
+	c.xRegister++
+	c.setFlag(Z, c.xRegister == 0x00)
+	c.setFlag(N, (c.xRegister&0x80) != 0)
+}
+
+func INY(c *CPU) {
+	c.yRegister++
+	c.setFlag(Z, c.yRegister == 0x00)
+	c.setFlag(N, (c.yRegister&0x80) != 0)
+}
+
+func JMP(c *CPU) {
+	if c.table[c.opcode].addrMode(c) {
+		c.pc = c.addrAbs
+		c.finish()
+	}
+}
+
+// JSR pushes the address of its own last byte, it's fetched only after the
+// pushes.
+func JSR(c *CPU) {
+	switch c.step {
+	case 2:
+		c.addrAbs = uint16(c.read(c.pc))
+		c.pc++
+	case 3:
+		c.read(0x0100 + uint16(c.stkp))
+	case 4:
+		c.push(uint8(c.pc >> 8))
+	case 5:
+		c.push(uint8(c.pc))
+	default:
+		c.addrAbs |= uint16(c.read(c.pc)) << 8
+		c.pc = c.addrAbs
+		c.finish()
+	}
+}
+
+func LDA(c *CPU) {
+	c.accumulator = c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func LDX(c *CPU) {
+	c.xRegister = c.fetched
+	c.setFlag(Z, c.xRegister == 0x00)
+	c.setFlag(N, (c.xRegister&0x80) != 0)
+}
+
+func LDY(c *CPU) {
+	c.yRegister = c.fetched
+	c.setFlag(Z, c.yRegister == 0x00)
+	c.setFlag(N, (c.yRegister&0x80) != 0)
+}
+
+func LSR(c *CPU) {
+	c.setFlag(C, c.fetched&0x01 != 0)
+	c.fetched >>= 1
+	c.setFlag(Z, c.fetched == 0x00)
+	c.setFlag(N, (c.fetched&0x80) != 0)
+}
+
+func NOP(c *CPU) {
+}
+
+func ORA(c *CPU) {
+	c.accumulator |= c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func PHA(c *CPU) {
+	if c.step == 2 {
+		c.read(c.pc)
+		return
+	}
+	c.push(c.accumulator)
+	c.finish()
+}
+
+func PHP(c *CPU) {
+	if c.step == 2 {
+		c.read(c.pc)
+		return
+	}
+	c.push(c.status | uint8(B) | uint8(U))
+	c.finish()
+}
+
+func PLA(c *CPU) {
+	switch c.step {
+	case 2:
+		c.read(c.pc)
+	case 3:
+		c.read(0x0100 + uint16(c.stkp))
+	default:
+		c.accumulator = c.pull()
+		c.setFlag(Z, c.accumulator == 0x00)
+		c.setFlag(N, (c.accumulator&0x80) != 0)
+		c.finish()
+	}
+}
+
+func PLP(c *CPU) {
+	switch c.step {
+	case 2:
+		c.read(c.pc)
+	case 3:
+		c.read(0x0100 + uint16(c.stkp))
+	default:
+		c.status = (c.pull() &^ uint8(B)) | uint8(U)
+		c.finish()
+	}
+}
+
+func ROL(c *CPU) {
+	carry := c.getFlag(C)
+	c.setFlag(C, (c.fetched&0x80) != 0)
+	c.fetched = (c.fetched << 1) | carry
+	c.setFlag(Z, c.fetched == 0x00)
+	c.setFlag(N, (c.fetched&0x80) != 0)
+}
+
+func ROR(c *CPU) {
+	carry := c.getFlag(C)
+	c.setFlag(C, c.fetched&0x01 != 0)
+	c.fetched = (carry << 7) | (c.fetched >> 1)
+	c.setFlag(Z, c.fetched == 0x00)
+	c.setFlag(N, c.fetched&0x80 != 0)
+}
+
+func RTI(c *CPU) {
+	switch c.step {
+	case 2:
+		c.read(c.pc)
+	case 3:
+		c.read(0x0100 + uint16(c.stkp))
+	case 4:
+		c.status = (c.pull() &^ uint8(B)) | uint8(U)
+	case 5:
+		c.pc = uint16(c.pull())
+	default:
+		c.pc |= uint16(c.pull()) << 8
+		c.finish()
+	}
+}
+
+func RTS(c *CPU) {
+	switch c.step {
+	case 2:
+		c.read(c.pc)
+	case 3:
+		c.read(0x0100 + uint16(c.stkp))
+	case 4:
+		c.pc = uint16(c.pull())
+	case 5:
+		c.pc |= uint16(c.pull()) << 8
+	default:
+		c.read(c.pc)
+		c.pc++
+		c.finish()
+	}
+}
+
+func SEC(c *CPU) {
+	c.setFlag(C, true)
+}
+
+func SED(c *CPU) {
+	c.setFlag(D, true)
+}
+
+func SEI(c *CPU) {
+	c.setFlag(I, true)
+}
+
+func STA(c *CPU) {
+	c.fetched = c.accumulator
+}
+
+func STX(c *CPU) {
+	c.fetched = c.xRegister
+}
+
+func STY(c *CPU) {
+	c.fetched = c.yRegister
+}
+
+func TAX(c *CPU) {
+	c.xRegister = c.accumulator
+	c.setFlag(Z, c.xRegister == 0x00)
+	c.setFlag(N, (c.xRegister&0x80) != 0)
+}
+
+func TAY(c *CPU) {
+	c.yRegister = c.accumulator
+	c.setFlag(Z, c.yRegister == 0x00)
+	c.setFlag(N, (c.yRegister&0x80) != 0)
+}
+
+func TSX(c *CPU) {
+	c.xRegister = c.stkp
+	c.setFlag(Z, c.xRegister == 0x00)
+	c.setFlag(N, (c.xRegister&0x80) != 0)
+}
+
+func TXA(c *CPU) {
+	c.accumulator = c.xRegister
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func TXS(c *CPU) {
+	c.stkp = c.xRegister
+}
+
+func TYA(c *CPU) {
+	c.accumulator = c.yRegister
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func XXX(c *CPU) {
+}
+
+// The unofficial opcodes below are the stable ones, the combinations of two
+// official operations that the 6502's decoder produces for unused slots.
+
+func ALR(c *CPU) {
+	c.accumulator &= c.fetched
+	c.setFlag(C, c.accumulator&0x01 != 0)
+	c.accumulator >>= 1
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func ANC(c *CPU) {
+	c.accumulator &= c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+	c.setFlag(C, (c.accumulator&0x80) != 0)
+}
+
+func ARR(c *CPU) {
+	c.accumulator = ((c.accumulator & c.fetched) >> 1) | (c.getFlag(C) << 7)
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+	c.setFlag(C, (c.accumulator&0x40) != 0)
+	c.setFlag(V, ((c.accumulator>>6)^(c.accumulator>>5))&0x01 != 0)
+}
+
+func AXS(c *CPU) {
+	value := c.accumulator & c.xRegister
+	c.setFlag(C, value >= c.fetched)
+	c.xRegister = value - c.fetched
+	c.setFlag(Z, c.xRegister == 0x00)
+	c.setFlag(N, (c.xRegister&0x80) != 0)
+}
+
+func DCP(c *CPU) {
+	c.fetched--
+	c.setFlag(C, c.accumulator >= c.fetched)
+	c.setFlag(Z, c.accumulator == c.fetched)
+	c.setFlag(N, ((c.accumulator-c.fetched)&0x80) != 0)
+}
+
+func ISC(c *CPU) {
+	c.fetched++
+	c.addWithCarry(c.fetched ^ 0xFF)
+}
+
+// JAM locks up the CPU: it stops fetching instructions and ignores
+// interrupts until the console is reset. The console reports it with a
+// *JamError.
+func JAM(c *CPU) {
+	c.read(c.pc)
+	c.jammed = true
+	c.pc--
+	c.finish()
+}
+
+func LAS(c *CPU) {
+	c.stkp &= c.fetched
+	c.accumulator = c.stkp
+	c.xRegister = c.stkp
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func LAX(c *CPU) {
+	c.accumulator = c.fetched
+	c.xRegister = c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func RLA(c *CPU) {
+	ROL(c)
+	c.accumulator &= c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func RRA(c *CPU) {
+	ROR(c)
+	c.addWithCarry(c.fetched)
+}
+
+func SAX(c *CPU) {
+	c.fetched = c.accumulator & c.xRegister
+}
+
+func SLO(c *CPU) {
+	ASL(c)
+	c.accumulator |= c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+func SRE(c *CPU) {
+	LSR(c)
+	c.accumulator ^= c.fetched
+	c.setFlag(Z, c.accumulator == 0x00)
+	c.setFlag(N, (c.accumulator&0x80) != 0)
+}
+
+// storeHigh is the value shared by SHA, SHX, SHY and TAS. It's ANDed with
+// the high byte of the base address plus one and, when the index crossed a
+// page, the same value ends up on the high address lines.
+func (c *CPU) storeHigh(value uint8, index uint8) {
+	base := c.addrAbs - uint16(index)
+	value &= uint8(base>>8) + 1
+	if (c.addrAbs & 0xFF00) != (base & 0xFF00) {
+		c.addrAbs = (uint16(value) << 8) | (c.addrAbs & 0x00FF)
+	}
+	c.fetched = value
+}
+
+func SHA(c *CPU) {
+	c.storeHigh(c.accumulator&c.xRegister, c.yRegister)
+}
+
+func SHX(c *CPU) {
+	c.storeHigh(c.xRegister, c.yRegister)
+}
+
+func SHY(c *CPU) {
+	c.storeHigh(c.yRegister, c.xRegister)
+}
+
+func TAS(c *CPU) {
+	c.stkp = c.accumulator & c.xRegister
+	c.storeHigh(c.stkp, c.yRegister)
+}
+
+// JamError is returned by the console once the CPU has executed one of the
+// KIL/JAM opcodes. Only a reset gets it running again.
+type JamError struct {
+	Opcode  uint8
+	Address uint16
+}
+
+func (e *JamError) Error() string {
+	return fmt.Sprintf("cpu: jammed by opcode $%02X at $%04X", e.Opcode, e.Address)
+}
+
+type CPUFlag uint8
+
+const (
+	C = CPUFlag(1 << 0)
+	Z = CPUFlag(1 << 1)
+	I = CPUFlag(1 << 2)
+	D = CPUFlag(1 << 3)
+	B = CPUFlag(1 << 4)
+	U = CPUFlag(1 << 5)
+	V = CPUFlag(1 << 6)
+	N = CPUFlag(1 << 7)
+)
+
+// isComplete tells whether the CPU is between two instructions.
+func (c *CPU) isComplete() bool {
+	return c.step == 0 && c.interrupt == interruptNone
+}
+
+// fetchesOpcode tells whether the next clock fetches an opcode, as opposed
+// to continuing an instruction or starting an interrupt.
+func (c *CPU) fetchesOpcode() bool {
+	return c.isComplete() && !c.jammed && !c.prevNeedNmi && !c.prevRunIrq
+}
+
+func (c *CPU) getFlag(flag CPUFlag) uint8 {
+	if c.status&uint8(flag) != 0 {
+		return 1
+	}
+	return 0
+}
+
+func (c *CPU) setFlag(flag CPUFlag, v bool) {
+	if v {
+		c.status |= uint8(flag)
+	} else {
+		c.status &= ^uint8(flag)
+	}
+}
+
+func (c *CPU) read(addr uint16) uint8 {
+	return c.bus.cpuRead(addr, false)
+}
+
+func (c *CPU) write(addr uint16, data uint8) {
+	c.bus.cpuWrite(addr, data)
+}
+
+func (c *CPU) push(data uint8) {
+	c.write(0x0100+uint16(c.stkp), data)
+	c.stkp--
+}
+
+func (c *CPU) pull() uint8 {
+	c.stkp++
+	return c.read(0x0100 + uint16(c.stkp))
+}
+
+func (c *CPU) connectBus(bus cpuBus) {
+	c.bus = bus
+}
+
+// setNMI drives the NMI line, asserted meaning the PPU is pulling /NMI low.
+func (c *CPU) setNMI(asserted bool) {
+	c.nmiLine = asserted
+}
+
+// setIRQ asserts or releases one of the IRQ sources.
+func (c *CPU) setIRQ(source uint8, asserted bool) {
+	if asserted {
+		c.irqLines |= source
+	} else {
+		c.irqLines &^= source
+	}
+}
+
+// sampleInterrupts runs at the end of every cycle, see the interrupt lines
+// of CPU.
+func (c *CPU) sampleInterrupts() {
+	c.prevNeedNmi = c.needNmi
+	if c.nmiLine && !c.nmiPrevLine {
+		c.needNmi = true
+	}
+	c.nmiPrevLine = c.nmiLine
+
+	c.prevRunIrq = c.runIrq
+	c.runIrq = c.irqLines != 0 && c.getFlag(I) == 0
+}
+
+// interruptSequence runs the cycles BRK, IRQ, NMI and reset have in common
+// after the opcode fetch (a dummy read for the hardware interrupts): another
+// read, three pushes and the two vector reads. Reset does reads instead of
+// the pushes, the stack pointer still goes down by three.
+func (c *CPU) interruptSequence(kind interruptKind) {
+	switch c.step {
+	case 2:
+		c.read(c.pc)
+		if kind == interruptBRK {
+			c.pc++
+		}
+	case 3:
+		c.pushInterrupt(kind, uint8(c.pc>>8))
+	case 4:
+		c.pushInterrupt(kind, uint8(c.pc))
+	case 5:
+		switch {
+		case kind == interruptReset:
+			c.addrAbs = 0xFFFC
+		case c.needNmi:
+			c.needNmi = false
+			c.addrAbs = 0xFFFA
+		default:
+			c.addrAbs = 0xFFFE
+		}
+		status := c.status | uint8(U)
+		if kind == interruptBRK {
+			status |= uint8(B)
+		}
+		c.pushInterrupt(kind, status)
+		c.setFlag(I, true)
+	case 6:
+		c.fetched = c.read(c.addrAbs)
+	default:
+		c.pc = (uint16(c.read(c.addrAbs+1)) << 8) | uint16(c.fetched)
+		// The first instruction of the handler always runs, even if
+		// another NMI is already waiting
+		c.prevNeedNmi = false
+		c.finish()
+	}
+}
+
+func (c *CPU) pushInterrupt(kind interruptKind, data uint8) {
+	if kind == interruptReset {
+		c.read(0x0100 + uint16(c.stkp))
+		c.stkp--
+		return
+	}
+	c.push(data)
+}
+
+// execute runs one cycle of an instruction that isn't custom: the
+// addressing mode's cycles first, then the accesses at the effective
+// address that the operation's kind calls for.
+func (c *CPU) execute(op *opcodeEntry) {
+	if !c.addressed {
+		c.addressed = op.addrMode(c)
+		if op.mode != modeIMP && op.mode != modeIMM {
+			if c.addressed && c.operandRead && op.access == accessRead {
+				op.run(c)
+				c.finish()
+			}
+			return
+		}
+	}
+
+	switch op.access {
+	case accessNone:
+		c.read(c.pc)
+		op.run(c)
+		c.finish()
+	case accessRead:
+		if op.mode == modeIMP {
+			c.read(c.pc)
+		} else {
+			c.fetched = c.read(c.addrAbs)
+		}
+		op.run(c)
+		c.finish()
+	case accessWrite:
+		op.run(c)
+		c.write(c.addrAbs, c.fetched)
+		c.finish()
+	case accessModify:
+		if op.mode == modeIMP {
+			c.read(c.pc)
+			c.fetched = c.accumulator
+			op.run(c)
+			c.accumulator = c.fetched
+			c.finish()
+			return
+		}
+		c.operandCycle++
+		switch c.operandCycle {
+		case 1:
+			c.fetched = c.read(c.addrAbs)
+		case 2:
+			// The old value is written back while the ALU works
+			c.write(c.addrAbs, c.fetched)
+			op.run(c)
+		default:
+			c.write(c.addrAbs, c.fetched)
+			c.finish()
+		}
+	}
+}
+
+func (c *CPU) finish() {
+	c.step = 0
+	c.interrupt = interruptNone
+	c.addressed = false
+	c.operandRead = false
+	c.operandCycle = 0
+}
+
+func (c *CPU) clock() {
+	c.cycleCount++
+	if c.jammed {
+		return
+	}
+
+	c.step++
+	switch {
+	case c.step == 1:
+		c.setFlag(U, true)
+		if c.interrupt == interruptNone {
+			if c.prevNeedNmi {
+				c.interrupt = interruptNMI
+			} else if c.prevRunIrq {
+				c.interrupt = interruptIRQ
+			}
+		}
+		if c.interrupt != interruptNone {
+			// The opcode fetch still happens, its result is thrown away
+			c.read(c.pc)
+			break
+		}
+		c.previousOpcode = c.opcode
+		c.previousPc = c.pc
+		c.opcode = c.read(c.pc)
+		c.pc++
+	case c.interrupt != interruptNone:
+		c.interruptSequence(c.interrupt)
+	case c.table[c.opcode].access == accessCustom:
+		c.table[c.opcode].run(c)
+	default:
+		c.execute(&c.table[c.opcode])
+	}
+	c.sampleInterrupts()
+}
+
+//go:embed lookup.json
+var lookupJSON []byte
+
+// instructionTable is compiled once from the built-in lookup and copied
+// into every CPU.
+var instructionTable = compileInstructions(loadInstructions())
+
+func loadInstructions() []Instruction {
+	var result []Instruction
+	errJson := json.Unmarshal(lookupJSON, &result)
+	if errJson != nil {
+		panic(errJson)
+	}
+	return result
+}
+
+func NewCPU() *CPU {
+
+	cpu := &CPU{
+		accumulator: 0x00,
+		xRegister:   0x00,
+		yRegister:   0x00,
+		stkp:        0x00,
+		pc:          0x0000,
+		status:      0x00,
+		fetched:     0x00,
+		addrAbs:     0x0000,
+		addrRel:     0x0000,
+		opcode:      0x00,
+	}
+	cpu.table = instructionTable
+
+	return cpu
+}
+
+// reset starts the 7 cycle reset sequence, which loads PC from $FFFC.
+func (c *CPU) reset() {
+	c.accumulator = 0
+	c.xRegister = 0
+	c.yRegister = 0
+	c.stkp = 0x00
+	c.status = 0x00 | uint8(U)
+
+	c.addrRel = 0x0000
+	c.addrAbs = 0x0000
+	c.fetched = 0x00
+	c.jammed = false
+	c.needNmi = false
+	c.prevNeedNmi = false
+	c.runIrq = false
+	c.prevRunIrq = false
+
+	c.finish()
+	c.interrupt = interruptReset
+}
+
+func numToHex(n int, d int) string {
+	format := "%0" + strconv.Itoa(d) + "x"
+	return fmt.Sprintf(format, n)
+}
+
+type DissambledInstruction struct {
+	instruction  string
+	nextAddr     uint16
+	previousAddr uint16
+}
+
+func (c *CPU) disassemble(nStart uint16, nStop uint16) map[uint16]DissambledInstruction {
+	addr := uint32(nStart)
+	value := uint8(0)
+	lo := uint8(0)
+	hi := uint8(0)
+	mapLines := make(map[uint16]DissambledInstruction)
+	lineAddr := uint16(0)
+	for addr <= uint32(nStop) {
+		previousAddr := lineAddr
+		lineAddr = uint16(addr)
+		sInst := "$" + numToHex(int(addr), 4) + ": "
+		opcode := c.bus.cpuRead(uint16(addr), true)
+		addr++
+		sInst += c.table[opcode].name + " "
+
+		if c.table[opcode].mode == modeIMP {
+			sInst += " {IMP}"
+		} else if c.table[opcode].mode == modeIMM {
+			value = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			sInst += "#$" + numToHex(int(value), 2) + " {IMM}"
+		} else if c.table[opcode].mode == modeZP0 {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = 0x00
+			sInst += "$" + numToHex(int(lo), 2) + " {ZP0}"
+		} else if c.table[opcode].mode == modeZPX {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = 0x00
+			sInst += "$" + numToHex(int(lo), 2) + ", X {ZPX}"
+		} else if c.table[opcode].mode == modeZPY {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = 0x00
+			sInst += "$" + numToHex(int(lo), 2) + ", Y {ZPY}"
+		} else if c.table[opcode].mode == modeIZX {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = 0x00
+			sInst += "($" + numToHex(int(lo), 2) + ", X) {IZX}"
+		} else if c.table[opcode].mode == modeIZY {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = 0x00
+			sInst += "($" + numToHex(int(lo), 2) + "), Y {IZY}"
+		} else if c.table[opcode].mode == modeABS {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			sInst += "$" + numToHex(int((uint16(hi)<<8)|uint16(lo)), 4) + " {ABS}"
+		} else if c.table[opcode].mode == modeABX {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			sInst += "$" + numToHex(int((uint16(hi)<<8)|uint16(lo)), 4) + ", X {ABX}"
+		} else if c.table[opcode].mode == modeABY {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			d := int((uint16(hi) << 8) | uint16(lo))
+			sInst += "$" + numToHex(d, 4) + ", Y {ABY}"
+		} else if c.table[opcode].mode == modeIND {
+			lo = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			hi = c.bus.cpuRead(uint16(addr), true)
+			addr++
+			sInst += "($" + numToHex(int((uint16(hi)<<8)|uint16(lo)), 4) + ") {IND}"
+		} else if c.table[opcode].mode == modeREL {
+			addrRel := uint16(c.bus.cpuRead(uint16(addr), true))
+			if addrRel&0x80 != 0 {
+				addrRel |= 0xFF00
+			}
+			addr++
+			sInst += "$" + numToHex(int(value), 2) + " [$" + numToHex(int(uint16(addr)+uint16(addrRel)), 4) + "] {REL}"
+		}
+
+		// Add the formed string to a std::map, using the instruction's
+		// address as the key. This makes it convenient to look for later
+		// as the instructions are variable in length, so a straight up
+		// incremental index is not sufficient.
+		mapLines[lineAddr] = DissambledInstruction{
+			instruction:  sInst,
+			previousAddr: previousAddr,
+			nextAddr:     uint16(addr),
+		}
+	}
+	return mapLines
+}
@@ -0,0 +1,174 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newTestConsole builds a console with an NROM cartridge that has program
+// at $C000 and the reset vector pointing at it. The reset sequence has
+// already run.
+func newTestConsole(t *testing.T, program []byte) *Console {
+	image := makeImage(1, 1, 0)
+	copy(image[16:], program)
+	image[16+0x3FFC] = 0x00
+	image[16+0x3FFD] = 0xC0
+	cart, err := LoadCartridge(bytes.NewReader(image))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	console := NewConsole()
+	console.bus.insertCartridge(cart)
+	console.Reset()
+	for !console.cpu.isComplete() {
+		console.cpu.clock()
+	}
+	return console
+}
+
+// stepCPU runs the CPU alone for one instruction and returns the cycles it
+// took.
+func stepCPU(cpu *CPU) int {
+	cycles := 0
+	for {
+		cpu.clock()
+		cycles++
+		if cpu.isComplete() {
+			return cycles
+		}
+	}
+}
+
+func TestUnofficialNops(t *testing.T) {
+	console := newTestConsole(t, []byte{
+		0x1A,       // NOP
+		0x80, 0xFF, // NOP #$FF
+		0x04, 0x10, // NOP $10
+		0x14, 0x10, // NOP $10,X
+		0x0C, 0x00, 0x02, // NOP $0200
+		0x1C, 0xFF, 0x02, // NOP $02FF,X (page crossed with X=1)
+		0xA2, 0x01, // LDX #$01
+	})
+	cpu := console.cpu
+	cpu.xRegister = 1
+	expected := []struct {
+		pc     uint16
+		cycles int
+	}{{0xC001, 2}, {0xC003, 2}, {0xC005, 3}, {0xC007, 4}, {0xC00A, 4}, {0xC00D, 5}}
+	for _, e := range expected {
+		assert.Equal(t, e.cycles, stepCPU(cpu))
+		assert.Equal(t, e.pc, cpu.pc)
+	}
+	assert.Equal(t, uint8(0x01), cpu.xRegister)
+}
+
+func TestUnofficialOpcodes(t *testing.T) {
+	console := newTestConsole(t, []byte{
+		0xA7, 0x10, // LAX $10
+		0x87, 0x11, // SAX $11
+		0xC7, 0x12, // DCP $12
+		0xE7, 0x13, // ISC $13
+		0x07, 0x14, // SLO $14
+		0x47, 0x15, // SRE $15
+		0xCB, 0x02, // AXS #$02
+		0xEB, 0x01, // SBC #$01
+	})
+	cpu := console.cpu
+	bus := console.bus
+	bus.cpuWrite(0x0010, 0x8F)
+	bus.cpuWrite(0x0012, 0x90)
+	bus.cpuWrite(0x0013, 0x0F)
+	bus.cpuWrite(0x0014, 0x81)
+	bus.cpuWrite(0x0015, 0x03)
+
+	assert.Equal(t, 3, stepCPU(cpu))
+	assert.Equal(t, uint8(0x8F), cpu.accumulator)
+	assert.Equal(t, uint8(0x8F), cpu.xRegister)
+	assert.Equal(t, uint8(1), cpu.getFlag(N))
+
+	cpu.xRegister = 0xF0
+	assert.Equal(t, 3, stepCPU(cpu))
+	assert.Equal(t, uint8(0x80), bus.cpuRead(0x0011, true))
+
+	// $90 - 1 = $8F, equal to A
+	assert.Equal(t, 5, stepCPU(cpu))
+	assert.Equal(t, uint8(0x8F), bus.cpuRead(0x0012, true))
+	assert.Equal(t, uint8(1), cpu.getFlag(Z))
+	assert.Equal(t, uint8(1), cpu.getFlag(C))
+
+	// $0F + 1 = $10, A = $8F - $10 with carry set
+	assert.Equal(t, 5, stepCPU(cpu))
+	assert.Equal(t, uint8(0x10), bus.cpuRead(0x0013, true))
+	assert.Equal(t, uint8(0x7F), cpu.accumulator)
+	assert.Equal(t, uint8(1), cpu.getFlag(V))
+
+	// $81 << 1 = $02 with carry, A = $7F | $02
+	assert.Equal(t, 5, stepCPU(cpu))
+	assert.Equal(t, uint8(0x02), bus.cpuRead(0x0014, true))
+	assert.Equal(t, uint8(0x7F), cpu.accumulator)
+	assert.Equal(t, uint8(1), cpu.getFlag(C))
+
+	// $03 >> 1 = $01 with carry, A = $7F ^ $01
+	assert.Equal(t, 5, stepCPU(cpu))
+	assert.Equal(t, uint8(0x01), bus.cpuRead(0x0015, true))
+	assert.Equal(t, uint8(0x7E), cpu.accumulator)
+
+	// X = ($7E & $F0) - 2
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, uint8(0x6E), cpu.xRegister)
+	assert.Equal(t, uint8(1), cpu.getFlag(C))
+
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, uint8(0x7D), cpu.accumulator)
+}
+
+func TestJam(t *testing.T) {
+	console := newTestConsole(t, []byte{
+		0xE8, // INX
+		0x02, // JAM
+		0xE8, // INX
+	})
+
+	assert.NoError(t, console.StepInstruction())
+	err := console.StepInstruction()
+	var jam *JamError
+	assert.True(t, errors.As(err, &jam))
+	assert.Equal(t, uint8(0x02), jam.Opcode)
+	assert.Equal(t, uint16(0xC001), jam.Address)
+
+	// Nothing runs anymore, but frames still complete
+	assert.Error(t, console.StepInstruction())
+	assert.Error(t, console.StepFrame())
+	assert.Equal(t, uint8(1), console.cpu.xRegister)
+
+	console.Reset()
+	assert.NoError(t, console.StepInstruction())
+	assert.NoError(t, console.StepInstruction())
+	assert.Equal(t, uint8(1), console.cpu.xRegister)
+}
+
+// TestInstructionCycles checks every opcode against the cycle count in the
+// lookup table, which is for no page crossing and branches not taken, and
+// that each of those cycles makes exactly one bus access.
+func TestInstructionCycles(t *testing.T) {
+	for opcode, entry := range instructionTable {
+		cycles := 0
+		for _, status := range []uint8{0x24, 0xE7} {
+			bus := &ramBus{}
+			bus.ram[0x0200] = uint8(opcode)
+			cpu := NewCPU()
+			cpu.connectBus(bus)
+			cpu.pc = 0x0200
+			cpu.stkp = 0xFD
+			cpu.status = status
+			n := stepCPU(cpu)
+			assert.Equal(t, n, len(bus.cycles), "opcode %02X %s: bus accesses", opcode, entry.name)
+			if cycles == 0 || n < cycles {
+				cycles = n
+			}
+		}
+		assert.Equal(t, int(entry.cycles), cycles, "opcode %02X %s", opcode, entry.name)
+	}
+}
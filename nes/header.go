@@ -0,0 +1,180 @@
+package nes
+
+import (
+	"fmt"
+	"nes-emu/mapper"
+)
+
+// Header is the 16 byte iNES header. The last eight bytes only have a
+// well-defined meaning in NES 2.0 images; iNES 1.0 uses PrgRamSize and
+// TvSystem1 and leaves the rest zero.
+type Header struct {
+	Name         [4]byte
+	PrgRomChunks uint8
+	ChrRomChunks uint8
+	Mapper1      uint8
+	Mapper2      uint8
+	PrgRamSize   uint8 // NES 2.0: mapper bits 8-11 and submapper
+	TvSystem1    uint8 // NES 2.0: PRG/CHR ROM size MSB
+	TvSystem2    uint8 // NES 2.0: PRG-RAM/PRG-NVRAM shift counts
+	ChrRamSize   uint8 // NES 2.0: CHR-RAM/CHR-NVRAM shift counts
+	Timing       uint8
+	SystemType   uint8
+	MiscRoms     uint8
+	Expansion    uint8
+}
+
+type FileFormat uint8
+
+const (
+	FormatINES  = FileFormat(1)
+	FormatNES20 = FileFormat(2)
+)
+
+type Timing uint8
+
+const (
+	TimingNTSC  = Timing(0)
+	TimingPAL   = Timing(1)
+	TimingMulti = Timing(2)
+	TimingDendy = Timing(3)
+)
+
+type ConsoleType uint8
+
+const (
+	ConsoleNES        = ConsoleType(0)
+	ConsoleVsSystem   = ConsoleType(1)
+	ConsolePlaychoice = ConsoleType(2)
+	ConsoleExtended   = ConsoleType(3)
+)
+
+// CartridgeInfo is everything the header tells about the board. Sizes are
+// in bytes. For iNES 1.0 images the fields NES 2.0 added are inferred the
+// same way most dumps expect: 8KB of PRG-RAM and, without CHR ROM, 8KB of
+// CHR-RAM.
+type CartridgeInfo struct {
+	Format    FileFormat
+	Mapper    uint16
+	Submapper uint8
+
+	PrgRomSize   uint32
+	ChrRomSize   uint32
+	PrgRamSize   uint32
+	PrgNvramSize uint32
+	ChrRamSize   uint32
+	ChrNvramSize uint32
+
+	Mirror     mapper.MIRROR
+	FourScreen bool
+	Battery    bool
+	Trainer    bool
+
+	Timing          Timing
+	Console         ConsoleType
+	VsPPU           uint8
+	VsHardware      uint8
+	ExtendedConsole uint8
+	MiscRoms        uint8
+	ExpansionDevice uint8
+}
+
+func (h *Header) isNES20() bool {
+	return h.Mapper2&0x0C == 0x08
+}
+
+// romSize decodes a NES 2.0 ROM size. When the MSB nibble is 0xF the LSB
+// holds an exponent and a multiplier instead of a count of units.
+func romSize(lsb uint8, msb uint8, unit uint32) uint64 {
+	if msb == 0x0F {
+		exponent := lsb >> 2
+		if exponent >= 48 {
+			return ^uint64(0)
+		}
+		multiplier := uint64(lsb&0x03)*2 + 1
+		return (uint64(1) << exponent) * multiplier
+	}
+	return (uint64(msb)<<8 | uint64(lsb)) * uint64(unit)
+}
+
+// ramSize decodes a NES 2.0 RAM shift count, zero meaning no RAM.
+func ramSize(shift uint8) uint32 {
+	if shift == 0 {
+		return 0
+	}
+	return 64 << shift
+}
+
+func parseHeader(header Header) (CartridgeInfo, error) {
+	info := CartridgeInfo{
+		Mapper:     uint16(header.Mapper2&0xF0) | uint16(header.Mapper1>>4),
+		Mirror:     mapper.HORIZONTAL,
+		FourScreen: header.Mapper1&0x08 != 0,
+		Battery:    header.Mapper1&0x02 != 0,
+		Trainer:    header.Mapper1&0x04 != 0,
+		Console:    ConsoleType(header.Mapper2 & 0x03),
+	}
+	if header.Mapper1&0x01 != 0 {
+		info.Mirror = mapper.VERTICAL
+	}
+
+	var prgRomSize, chrRomSize uint64
+	if header.isNES20() {
+		info.Format = FormatNES20
+		info.Mapper |= uint16(header.PrgRamSize&0x0F) << 8
+		info.Submapper = header.PrgRamSize >> 4
+
+		prgRomSize = romSize(header.PrgRomChunks, header.TvSystem1&0x0F, 16384)
+		chrRomSize = romSize(header.ChrRomChunks, header.TvSystem1>>4, 8192)
+
+		info.PrgRamSize = ramSize(header.TvSystem2 & 0x0F)
+		info.PrgNvramSize = ramSize(header.TvSystem2 >> 4)
+		info.ChrRamSize = ramSize(header.ChrRamSize & 0x0F)
+		info.ChrNvramSize = ramSize(header.ChrRamSize >> 4)
+
+		info.Timing = Timing(header.Timing & 0x03)
+		switch info.Console {
+		case ConsoleVsSystem:
+			info.VsPPU = header.SystemType & 0x0F
+			info.VsHardware = header.SystemType >> 4
+		case ConsoleExtended:
+			info.ExtendedConsole = header.SystemType & 0x0F
+		}
+		info.MiscRoms = header.MiscRoms & 0x03
+		info.ExpansionDevice = header.Expansion & 0x3F
+	} else {
+		info.Format = FormatINES
+		// Old dumps sometimes have a ripper's signature in bytes 7-15, in
+		// which case the upper mapper nibble is garbage as well
+		if header.ChrRamSize|header.Timing|header.SystemType|header.MiscRoms|header.Expansion != 0 {
+			info.Mapper &= 0x0F
+			info.Console = ConsoleNES
+		}
+
+		prgRomSize = uint64(header.PrgRomChunks) * 16384
+		chrRomSize = uint64(header.ChrRomChunks) * 8192
+
+		info.PrgRamSize = uint32(header.PrgRamSize) * 8192
+		if info.PrgRamSize == 0 {
+			info.PrgRamSize = 8192
+		}
+		if chrRomSize == 0 {
+			info.ChrRamSize = 8192
+		}
+		if header.TvSystem1&0x01 != 0 {
+			info.Timing = TimingPAL
+		}
+	}
+
+	// Every board banks PRG in 16KB and CHR in 8KB multiples, and the bank
+	// counts have to fit the mappers' registers
+	if prgRomSize == 0 || prgRomSize%16384 != 0 || prgRomSize/16384 > 0xFF {
+		return info, fmt.Errorf("%w: %d bytes of PRG ROM", ErrInvalidSize, prgRomSize)
+	}
+	if chrRomSize%8192 != 0 || chrRomSize/8192 > 0xFF {
+		return info, fmt.Errorf("%w: %d bytes of CHR ROM", ErrInvalidSize, chrRomSize)
+	}
+	info.PrgRomSize = uint32(prgRomSize)
+	info.ChrRomSize = uint32(chrRomSize)
+	return info, nil
+}
@@ -0,0 +1,237 @@
+package nes
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newInterruptCPU runs program from $0200 on flat RAM, with the IRQ/BRK
+// handler at $0300 and the NMI handler at $0400, both filled with NOPs.
+func newInterruptCPU(program []byte, status uint8) (*CPU, *ramBus) {
+	bus := &ramBus{}
+	copy(bus.ram[0x0200:], program)
+	for i := 0; i < 0x10; i++ {
+		bus.ram[0x0300+i] = 0xEA
+		bus.ram[0x0400+i] = 0xEA
+	}
+	bus.ram[0xFFFA], bus.ram[0xFFFB] = 0x00, 0x04
+	bus.ram[0xFFFE], bus.ram[0xFFFF] = 0x00, 0x03
+	cpu := NewCPU()
+	cpu.connectBus(bus)
+	cpu.pc = 0x0200
+	cpu.stkp = 0xFD
+	cpu.status = status
+	return cpu, bus
+}
+
+// returnAddress is the address the last interrupt pushed on the stack.
+func returnAddress(cpu *CPU, bus *ramBus) uint16 {
+	return uint16(bus.ram[0x0100+uint16(cpu.stkp)+3])<<8 | uint16(bus.ram[0x0100+uint16(cpu.stkp)+2])
+}
+
+func TestCLILatency(t *testing.T) {
+	cpu, bus := newInterruptCPU([]byte{
+		0x58, // CLI
+		0xEA, // NOP
+		0xEA, // NOP
+	}, 0x24)
+	cpu.setIRQ(irqMapper, true)
+
+	// The instruction after CLI still runs before the IRQ is taken
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0202), cpu.pc)
+	assert.Equal(t, 7, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0300), cpu.pc)
+	assert.Equal(t, uint16(0x0202), returnAddress(cpu, bus))
+	assert.Equal(t, uint8(1), cpu.getFlag(I))
+}
+
+func TestSEILatency(t *testing.T) {
+	cpu, bus := newInterruptCPU([]byte{
+		0x78, // SEI
+		0xEA, // NOP
+	}, 0x20)
+	cpu.setIRQ(irqFrameCounter, true)
+
+	// The IRQ was polled before SEI set I, so it's taken right after it,
+	// with I set in the pushed flags
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, 7, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0300), cpu.pc)
+	assert.Equal(t, uint16(0x0201), returnAddress(cpu, bus))
+	assert.NotZero(t, bus.ram[0x0100+uint16(cpu.stkp)+1]&uint8(I))
+}
+
+func TestBranchDelaysIRQ(t *testing.T) {
+	cpu, bus := newInterruptCPU([]byte{
+		0xD0, 0x00, // BNE +0, taken without crossing a page
+		0xEA, // NOP
+		0xEA, // NOP
+	}, 0x20)
+
+	// The IRQ shows up while the branch offset is fetched
+	cpu.clock()
+	cpu.setIRQ(irqMapper, true)
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0202), cpu.pc)
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, 7, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0300), cpu.pc)
+	assert.Equal(t, uint16(0x0203), returnAddress(cpu, bus))
+}
+
+func TestNMIEdge(t *testing.T) {
+	cpu, _ := newInterruptCPU([]byte{0xEA, 0xEA, 0xEA}, 0x24)
+	cpu.setNMI(true)
+
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, 7, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0400), cpu.pc)
+
+	// Holding the line doesn't give another NMI
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, 2, stepCPU(cpu))
+	}
+	assert.Equal(t, uint16(0x0404), cpu.pc)
+
+	cpu.setNMI(false)
+	assert.Equal(t, 2, stepCPU(cpu))
+	cpu.setNMI(true)
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, 7, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0400), cpu.pc)
+}
+
+func TestNMIHijacksBRK(t *testing.T) {
+	cpu, bus := newInterruptCPU([]byte{0x00, 0xEA, 0xEA}, 0x24)
+
+	cpu.clock()
+	cpu.clock()
+	cpu.clock()
+	cpu.setNMI(true)
+	assert.Equal(t, 4, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0400), cpu.pc)
+	assert.Equal(t, uint16(0x0202), returnAddress(cpu, bus))
+	assert.NotZero(t, bus.ram[0x0100+uint16(cpu.stkp)+1]&uint8(B))
+
+	// The NMI was consumed by the BRK, and the handler's first instruction
+	// runs before anything else
+	assert.Equal(t, 2, stepCPU(cpu))
+	assert.Equal(t, uint16(0x0401), cpu.pc)
+}
+
+func TestFrameCounterIRQ(t *testing.T) {
+	console := newTestConsole(t, []byte{0xEA})
+	bus := console.bus
+	bus.cpuWrite(0x4017, 0x00)
+
+	for !bus.apu.frameIRQ {
+		bus.clock()
+	}
+	assert.Equal(t, uint8(0x40), bus.cpuRead(0x4015, true))
+	assert.Equal(t, uint8(0x40), bus.cpuRead(0x4015, false))
+	assert.Equal(t, uint8(0x00), bus.cpuRead(0x4015, false))
+
+	// Inhibiting the interrupt also acknowledges it
+	for !bus.apu.frameIRQ {
+		bus.clock()
+	}
+	bus.cpuWrite(0x4017, 0x40)
+	assert.False(t, bus.apu.frameIRQ)
+
+	// The 5-step sequence never raises it
+	bus.cpuWrite(0x4017, 0x80)
+	for i := 0; i < 2*18641*6; i++ {
+		bus.clock()
+	}
+	assert.False(t, bus.apu.frameIRQ)
+}
+
+// newTimingConsole runs program from $C000 on the whole system, the CPU and
+// the PPU starting together like at power up. The rest of PRG ROM is NOPs,
+// the NMI handler at $FF00 included.
+func newTimingConsole(t *testing.T, program []byte) *Console {
+	image := makeImage(1, 1, 0)
+	prg := image[16 : 16+0x4000]
+	for i := range prg {
+		prg[i] = 0xEA
+	}
+	copy(prg, program)
+	copy(prg[0x3FFA:], []byte{0x00, 0xFF, 0x00, 0xC0, 0x00, 0xFF})
+	cart, err := LoadCartridge(bytes.NewReader(image))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	console := NewConsole()
+	console.bus.insertCartridge(cart)
+	console.Reset()
+	assert.NoError(t, console.StepInstruction())
+	return console
+}
+
+// cpuCycle is the index of the CPU cycle the next system tick runs or,
+// between two, the next one it will run.
+func cpuCycle(bus *Bus) uint64 {
+	return (bus.systemClockCounter + 2) / 3
+}
+
+func TestNMITiming(t *testing.T) {
+	// The vertical blank starts on dot 1 of line 241. The CPU sees the line
+	// from the cycle that dot falls in, and takes the NMI after the first
+	// instruction whose next-to-last cycle isn't earlier: with NOPs, 2 or 3
+	// cycles later depending on where the NOPs start.
+	for _, test := range []struct {
+		name    string
+		program []byte
+		latency uint64
+	}{
+		{"NOPs at even cycles", []byte{0xA9, 0x80, 0x8D, 0x00, 0x20}, 3},
+		{"NOPs at odd cycles", []byte{0xA9, 0x80, 0x8D, 0x00, 0x20, 0xA5, 0x00}, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			console := newTimingConsole(t, test.program)
+			bus := console.bus
+			for console.cpu.pc < 0xC000+uint16(len(test.program)) {
+				assert.NoError(t, console.StepInstruction())
+			}
+
+			var vblankDot, seen uint64
+			for {
+				if bus.systemClockCounter%3 == 0 && console.cpu.isComplete() && console.cpu.prevNeedNmi {
+					break
+				}
+				cycle := cpuCycle(bus)
+				bus.clock()
+				if vblankDot == 0 && console.ppu.nmi {
+					vblankDot = bus.systemClockCounter - 1
+					seen = cycle
+				}
+			}
+			assert.Equal(t, uint64(241*341+1), vblankDot)
+			assert.Equal(t, test.latency, cpuCycle(bus)-seen)
+		})
+	}
+}
+
+func TestNMIEnabledDuringVBlank(t *testing.T) {
+	// Enabling the NMI while the vertical blank flag is set raises it at
+	// once, it's taken after the instruction following the write
+	console := newTimingConsole(t, []byte{
+		0x4C, 0x00, 0xC0, // JMP $C000
+		0xA9, 0x80, // LDA #$80
+		0x8D, 0x00, 0x20, // STA $2000
+	})
+	for console.ppu.scanline != 245 {
+		assert.NoError(t, console.StepInstruction())
+	}
+	console.cpu.pc = 0xC003
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, console.StepInstruction())
+	}
+	assert.Equal(t, uint16(0xFF00), console.cpu.pc)
+	stack := 0x0100 + uint16(console.cpu.stkp)
+	returnAddress := uint16(console.bus.cpuRead(stack+3, true))<<8 | uint16(console.bus.cpuRead(stack+2, true))
+	assert.Equal(t, uint16(0xC009), returnAddress)
+}
@@ -0,0 +1,347 @@
+package nes
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Movie commands, done before the frame they're recorded with.
+const (
+	MovieSoftReset = uint8(0x01)
+	MovieHardReset = uint8(0x02)
+)
+
+var (
+	ErrInvalidMovie     = errors.New("movie: not an FM2 movie")
+	ErrUnsupportedMovie = errors.New("movie: unsupported FM2 feature")
+	ErrMovieMismatch    = errors.New("movie: recorded with a different ROM")
+)
+
+// fm2Buttons are the button letters of an FM2 input line, the one at
+// index i being the button 1 << i.
+const fm2Buttons = "RLDUTSBA"
+
+// MovieFrame is the input of one frame: the buttons on both controllers
+// and the reset or power cycle done before it.
+type MovieFrame struct {
+	Commands uint8
+	Buttons  [2]uint8
+}
+
+// Movie is the input of every frame since power on, as stored in FCEUX's
+// .fm2 text format. Only movies with two standard controllers on NTSC are
+// supported.
+type Movie struct {
+	ROMFilename string
+	// ROMChecksum is the MD5 of PRG and CHR ROM, without the header
+	ROMChecksum   [md5.Size]byte
+	GUID          string
+	RerecordCount int
+	Comments      []string
+	Frames        []MovieFrame
+}
+
+// ReadFM2 parses an FM2 movie. Binary input logs, the Four Score, the Zapper
+// and PAL movies are rejected with ErrUnsupportedMovie, wrapped.
+func ReadFM2(r io.Reader) (*Movie, error) {
+	movie := &Movie{}
+	version := ""
+	hasChecksum := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		if text[0] == '|' {
+			frame, err := parseFM2Frame(text)
+			if err != nil {
+				return nil, fmt.Errorf("%w (line %d)", err, line)
+			}
+			movie.Frames = append(movie.Frames, frame)
+			continue
+		}
+
+		key, value, _ := strings.Cut(text, " ")
+		switch key {
+		case "version":
+			version = value
+		case "rerecordCount":
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: rerecordCount: %v", ErrInvalidMovie, line, err)
+			}
+			movie.RerecordCount = count
+		case "romFilename":
+			movie.ROMFilename = value
+		case "romChecksum":
+			checksum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+			if err != nil || len(checksum) != md5.Size {
+				return nil, fmt.Errorf("%w: line %d: bad romChecksum %q", ErrInvalidMovie, line, value)
+			}
+			copy(movie.ROMChecksum[:], checksum)
+			hasChecksum = true
+		case "guid":
+			movie.GUID = value
+		case "comment":
+			movie.Comments = append(movie.Comments, value)
+		case "binary", "fourscore", "palFlag", "port2", "FDS":
+			if value != "0" {
+				return nil, fmt.Errorf("%w: %s %s", ErrUnsupportedMovie, key, value)
+			}
+		case "port0", "port1":
+			if value != "0" && value != "1" {
+				return nil, fmt.Errorf("%w: %s %s", ErrUnsupportedMovie, key, value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if version != "3" {
+		return nil, fmt.Errorf("%w: version %q", ErrInvalidMovie, version)
+	}
+	if !hasChecksum {
+		return nil, fmt.Errorf("%w: no romChecksum", ErrInvalidMovie)
+	}
+	return movie, nil
+}
+
+// parseFM2Frame reads an input line like "|1|R..U...A|........||": the
+// commands, then the buttons of each port, a '.' or a space being a button
+// released. Ports without a controller are left empty.
+func parseFM2Frame(text string) (MovieFrame, error) {
+	frame := MovieFrame{}
+	fields := strings.Split(text, "|")
+	if len(fields) < 5 {
+		return frame, fmt.Errorf("%w: input line %q", ErrInvalidMovie, text)
+	}
+	commands, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return frame, fmt.Errorf("%w: commands %q", ErrInvalidMovie, fields[1])
+	}
+	if commands&^int(MovieSoftReset|MovieHardReset) != 0 {
+		return frame, fmt.Errorf("%w: commands %d", ErrUnsupportedMovie, commands)
+	}
+	frame.Commands = uint8(commands)
+	for port := range frame.Buttons {
+		buttons := fields[2+port]
+		if buttons == "" {
+			continue
+		}
+		if len(buttons) != len(fm2Buttons) {
+			return frame, fmt.Errorf("%w: port %d buttons %q", ErrInvalidMovie, port, buttons)
+		}
+		for i := 0; i < len(buttons); i++ {
+			if buttons[i] != '.' && buttons[i] != ' ' {
+				frame.Buttons[port] |= 1 << i
+			}
+		}
+	}
+	return frame, nil
+}
+
+// WriteFM2 writes the movie in FM2 format, with a standard controller on
+// both ports.
+func (m *Movie) WriteFM2(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "version 3\n")
+	fmt.Fprintf(b, "emuVersion 0\n")
+	fmt.Fprintf(b, "rerecordCount %d\n", m.RerecordCount)
+	fmt.Fprintf(b, "palFlag 0\n")
+	fmt.Fprintf(b, "romFilename %s\n", m.ROMFilename)
+	fmt.Fprintf(b, "romChecksum base64:%s\n", base64.StdEncoding.EncodeToString(m.ROMChecksum[:]))
+	fmt.Fprintf(b, "guid %s\n", m.GUID)
+	fmt.Fprintf(b, "fourscore 0\nmicrophone 0\nport0 1\nport1 1\nport2 0\nFDS 0\nNewPPU 0\n")
+	for _, comment := range m.Comments {
+		fmt.Fprintf(b, "comment %s\n", comment)
+	}
+	line := []byte("|0|........|........||\n")
+	for _, frame := range m.Frames {
+		b.WriteString("|" + strconv.Itoa(int(frame.Commands)) + "|")
+		for _, buttons := range frame.Buttons {
+			for i := range fm2Buttons {
+				line[i] = '.'
+				if buttons&(1<<i) != 0 {
+					line[i] = fm2Buttons[i]
+				}
+			}
+			b.Write(line[:len(fm2Buttons)])
+			b.WriteString("|")
+		}
+		b.WriteString("|\n")
+	}
+	return b.Flush()
+}
+
+func newMovieGUID() string {
+	var id [16]byte
+	// A failing random source only makes the GUID less unique
+	_, _ = rand.Read(id[:])
+	return fmt.Sprintf("%X-%X-%X-%X-%X", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// Movies are indexed by the frame count of the PPU, which restarts when
+// they do. It's part of save states, so loading one seeks the movie.
+type movieMode uint8
+
+const (
+	movieOff movieMode = iota
+	movieRecording
+	moviePlaying
+)
+
+// RecordMovie power cycles the console and records the input of every
+// frame from then on into movie, replacing its frames. Frames are recorded
+// by StepFrame; resets and power cycles are done at the start of the next
+// frame, so that playback reproduces them.
+func (c *Console) RecordMovie(movie *Movie) error {
+	cart := c.bus.cartridge
+	if cart == nil {
+		return ErrNoCartridge
+	}
+	c.StopMovie()
+	movie.ROMChecksum = cart.checksum
+	if movie.GUID == "" {
+		movie.GUID = newMovieGUID()
+	}
+	movie.Frames = movie.Frames[:0]
+	c.power()
+	c.movie = movie
+	c.movieMode = movieRecording
+	return nil
+}
+
+// PlayMovie power cycles the console and replays movie. The buttons set
+// with SetButtons and SetTurbo are ignored until the movie ends. Loading a
+// save state seeks the movie to the frame of the state; in read-write mode
+// it also truncates the movie there and records from then on, counting a
+// rerecord, like FCEUX does.
+func (c *Console) PlayMovie(movie *Movie, readOnly bool) error {
+	cart := c.bus.cartridge
+	if cart == nil {
+		return ErrNoCartridge
+	}
+	if movie.ROMChecksum != cart.checksum {
+		return ErrMovieMismatch
+	}
+	c.StopMovie()
+	c.power()
+	c.movie = movie
+	c.movieMode = moviePlaying
+	c.movieReadOnly = readOnly
+	return nil
+}
+
+// SetMovieReadOnly switches between read-only and read-write mode, see
+// PlayMovie.
+func (c *Console) SetMovieReadOnly(readOnly bool) {
+	c.movieReadOnly = readOnly
+}
+
+// MovieReadOnly tells the current mode, see PlayMovie.
+func (c *Console) MovieReadOnly() bool {
+	return c.movieReadOnly
+}
+
+// Recording tells whether a movie is being recorded.
+func (c *Console) Recording() bool {
+	return c.movieMode == movieRecording
+}
+
+// Playing tells whether a movie is being played back. It stops by itself
+// after the last frame.
+func (c *Console) Playing() bool {
+	return c.movieMode == moviePlaying
+}
+
+// StopMovie stops recording or playing. The controllers go back to the
+// buttons set with SetButtons and SetTurbo.
+func (c *Console) StopMovie() {
+	c.movie = nil
+	c.movieMode = movieOff
+	c.movieCommands = 0
+	c.bus.moviePlaying = false
+	c.bus.updateControllers()
+}
+
+// power starts a movie from power on.
+func (c *Console) power() {
+	c.bus.power()
+	c.ppu.frame = 0
+}
+
+// movieFrame runs at the start of every frame: it replays the frame or
+// records it.
+func (c *Console) movieFrame() {
+	if c.movieMode == movieOff {
+		return
+	}
+	index := int(c.ppu.frame)
+	if c.movieMode == moviePlaying && index >= len(c.movie.Frames) {
+		c.StopMovie()
+		return
+	}
+
+	var frame MovieFrame
+	if c.movieMode == movieRecording {
+		frame = MovieFrame{Commands: c.movieCommands}
+		c.movieCommands = 0
+	} else {
+		frame = c.movie.Frames[index]
+	}
+	if frame.Commands&MovieHardReset != 0 {
+		c.bus.power()
+	} else if frame.Commands&MovieSoftReset != 0 {
+		c.bus.reset()
+	}
+
+	if c.movieMode == movieRecording {
+		frame.Buttons = c.bus.controller
+		c.movie.Frames = append(c.movie.Frames[:index], frame)
+		return
+	}
+	c.bus.moviePlaying = true
+	c.bus.movieButtons = frame.Buttons
+	c.bus.updateControllers()
+}
+
+// movieRewound counts a rewind while recording as a rerecord.
+func (c *Console) movieRewound() {
+	if c.movieMode == movieRecording {
+		c.movie.RerecordCount++
+	}
+}
+
+// movieStateLoaded follows a save state being loaded: a read-only movie
+// plays from the frame of the state on, a read-write one is cut there and
+// recorded from then on.
+func (c *Console) movieStateLoaded() {
+	if c.movieMode == movieOff {
+		return
+	}
+	index := int(c.ppu.frame)
+	c.movieCommands = 0
+	if c.movieReadOnly {
+		c.movieMode = moviePlaying
+		return
+	}
+	if index > len(c.movie.Frames) {
+		// The state is past the end, the frames between can't be recorded
+		c.StopMovie()
+		return
+	}
+	c.movie.Frames = c.movie.Frames[:index]
+	c.movie.RerecordCount++
+	c.movieMode = movieRecording
+	c.bus.moviePlaying = false
+	c.bus.updateControllers()
+}
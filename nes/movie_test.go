@@ -0,0 +1,179 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// newMovieConsole runs a program that adds up, in RAM, the frames during
+// which A is held on port 0.
+func newMovieConsole(t *testing.T) *Console {
+	console := newTestConsole(t, []byte{
+		0xA9, 0x80, // LDA #$80
+		0x8D, 0x00, 0x20, // STA $2000
+		0x4C, 0x05, 0xC0, // JMP $C005
+		0xA9, 0x01, // LDA #$01
+		0x8D, 0x16, 0x40, // STA $4016
+		0xA9, 0x00, // LDA #$00
+		0x8D, 0x16, 0x40, // STA $4016
+		0xAD, 0x16, 0x40, // LDA $4016
+		0x29, 0x01, // AND #$01
+		0x18,             // CLC
+		0x6D, 0x00, 0x02, // ADC $0200
+		0x8D, 0x00, 0x02, // STA $0200
+		0x40, // RTI
+	})
+	console.bus.cartridge.prgMemory[0x3FFA] = 0x08
+	console.bus.cartridge.prgMemory[0x3FFB] = 0xC0
+	return console
+}
+
+func TestFM2RoundTrip(t *testing.T) {
+	movie := &Movie{
+		ROMFilename:   "game",
+		ROMChecksum:   [16]byte{1, 2, 3},
+		GUID:          "0123ABCD-0000-0000-0000-000000000000",
+		RerecordCount: 4,
+		Comments:      []string{"author someone"},
+		Frames: []MovieFrame{
+			{Buttons: [2]uint8{ButtonRight | ButtonA, ButtonB}},
+			{Commands: MovieSoftReset},
+			{Buttons: [2]uint8{ButtonStart | ButtonSelect | ButtonUp | ButtonDown | ButtonLeft}},
+		},
+	}
+	var fm2 bytes.Buffer
+	assert.NoError(t, movie.WriteFM2(&fm2))
+	assert.Contains(t, fm2.String(), "romChecksum base64:AQIDAAAAAAAAAAAAAAAAAA==\n")
+	assert.True(t, strings.HasSuffix(fm2.String(),
+		"|0|R......A|......B.||\n|1|........|........||\n|0|.LDUTS..|........||\n"))
+
+	read, err := ReadFM2(&fm2)
+	assert.NoError(t, err)
+	assert.Equal(t, movie, read)
+}
+
+func TestReadFM2Errors(t *testing.T) {
+	header := "version 3\nromFilename game\nromChecksum base64:AQIDAAAAAAAAAAAAAAAAAA==\n"
+	for _, test := range []struct {
+		fm2 string
+		err error
+	}{
+		{"romChecksum base64:AQIDAAAAAAAAAAAAAAAAAA==\n", ErrInvalidMovie},
+		{"version 3\n|0|........|........||\n", ErrInvalidMovie},
+		{header + "romChecksum base64:AQID\n", ErrInvalidMovie},
+		{header + "|0|........|\n", ErrInvalidMovie},
+		{header + "|0|....|........||\n", ErrInvalidMovie},
+		{header + "|x|........|........||\n", ErrInvalidMovie},
+		{header + "|4|........|........||\n", ErrUnsupportedMovie},
+		{header + "fourscore 1\n", ErrUnsupportedMovie},
+		{header + "port1 2\n", ErrUnsupportedMovie},
+		{header + "palFlag 1\n", ErrUnsupportedMovie},
+		{header + "binary 1\n", ErrUnsupportedMovie},
+	} {
+		_, err := ReadFM2(strings.NewReader(test.fm2))
+		assert.True(t, errors.Is(err, test.err), "%q: %v", test.fm2, err)
+	}
+
+	// Unused ports and CRLF line ends are fine
+	movie, err := ReadFM2(strings.NewReader(header + "port1 0\r\n|0|R.......|||\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []MovieFrame{{Buttons: [2]uint8{ButtonRight, 0}}}, movie.Frames)
+}
+
+func TestMoviePlayback(t *testing.T) {
+	console := newMovieConsole(t)
+	movie := &Movie{}
+	assert.NoError(t, console.RecordMovie(movie))
+	assert.True(t, console.Recording())
+	assert.Equal(t, console.bus.cartridge.checksum, movie.ROMChecksum)
+	assert.NotEmpty(t, movie.GUID)
+	for i := 0; i < 10; i++ {
+		if i%3 == 0 {
+			console.SetButtons(0, ButtonA)
+		} else {
+			console.SetButtons(0, 0)
+		}
+		if i == 7 {
+			console.Reset()
+		}
+		assert.NoError(t, console.StepFrame())
+	}
+	assert.Len(t, movie.Frames, 10)
+	assert.Equal(t, MovieFrame{Commands: MovieSoftReset}, movie.Frames[7])
+	var expected bytes.Buffer
+	assert.NoError(t, console.SaveState(&expected))
+	assert.NotZero(t, console.bus.cpuRam[0x200])
+
+	// Playback powers on and replays the same frames, whatever is held
+	console = newMovieConsole(t)
+	assert.NoError(t, console.PlayMovie(movie, true))
+	console.SetButtons(0, ButtonA)
+	for range movie.Frames {
+		assert.True(t, console.Playing())
+		assert.NoError(t, console.StepFrame())
+	}
+	var actual bytes.Buffer
+	assert.NoError(t, console.SaveState(&actual))
+	assert.Equal(t, expected.Bytes(), actual.Bytes())
+
+	// Past the end the buttons are back
+	assert.NoError(t, console.StepFrame())
+	assert.False(t, console.Playing())
+	assert.Equal(t, ButtonA, console.bus.controller[0])
+}
+
+func TestPlayMovieMismatch(t *testing.T) {
+	console := newMovieConsole(t)
+	movie := &Movie{}
+	assert.NoError(t, console.RecordMovie(movie))
+	assert.NoError(t, console.StepFrame())
+
+	other := newTestConsole(t, []byte{0xEA})
+	assert.Equal(t, ErrMovieMismatch, other.PlayMovie(movie, true))
+	assert.False(t, other.Playing())
+}
+
+func TestMovieRerecord(t *testing.T) {
+	console := newMovieConsole(t)
+	movie := &Movie{}
+	assert.NoError(t, console.RecordMovie(movie))
+	console.SetButtons(0, ButtonA)
+	var state bytes.Buffer
+	for i := 0; i < 6; i++ {
+		if i == 3 {
+			assert.NoError(t, console.SaveState(&state))
+		}
+		assert.NoError(t, console.StepFrame())
+	}
+	recorded := append([]MovieFrame(nil), movie.Frames...)
+
+	// Loading a state while recording cuts the movie there
+	assert.NoError(t, console.LoadState(bytes.NewReader(state.Bytes())))
+	assert.True(t, console.Recording())
+	assert.Equal(t, recorded[:3], movie.Frames)
+	assert.Equal(t, 1, movie.RerecordCount)
+	console.SetButtons(0, 0)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, console.StepFrame())
+	}
+	assert.Len(t, movie.Frames, 6)
+	assert.Equal(t, MovieFrame{}, movie.Frames[5])
+
+	// A read-only movie keeps playing from the state
+	assert.NoError(t, console.PlayMovie(movie, true))
+	assert.NoError(t, console.LoadState(bytes.NewReader(state.Bytes())))
+	assert.True(t, console.Playing())
+	assert.Len(t, movie.Frames, 6)
+	assert.NoError(t, console.StepFrame())
+	assert.Equal(t, uint8(0), console.bus.controller[0])
+
+	// A read-write one starts recording again
+	console.SetMovieReadOnly(false)
+	assert.NoError(t, console.LoadState(bytes.NewReader(state.Bytes())))
+	assert.True(t, console.Recording())
+	assert.Len(t, movie.Frames, 3)
+	assert.Equal(t, 2, movie.RerecordCount)
+}
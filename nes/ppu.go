@@ -1,15 +1,17 @@
-package main
+package nes
 
 import (
+	_ "embed"
 	"encoding/json"
 	"fmt"
 	"nes-emu/mapper"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	//"github.com/hajimehoshi/ebiten/v2"
 	"image"
 	"image/color"
-	"io"
 	"nes-emu/ppu"
 	"os"
 	"unsafe"
@@ -17,47 +19,47 @@ import (
 
 func CreateStatusRegister() ppu.Register {
 	return ppu.CreateRegister(map[string]ppu.Field{
-		"unused":          {0, 5},
-		"sprite_overflow": {5, 1},
-		"sprite_zero_hit": {6, 1},
-		"vertical_blank":  {7, 1},
+		"unused":          {Index: 0, Size: 5},
+		"sprite_overflow": {Index: 5, Size: 1},
+		"sprite_zero_hit": {Index: 6, Size: 1},
+		"vertical_blank":  {Index: 7, Size: 1},
 	})
 }
 
 func CreateMaskRegister() ppu.Register {
 	return ppu.CreateRegister(map[string]ppu.Field{
-		"grayscale":              {0, 1},
-		"render_background_left": {1, 1},
-		"render_sprites_left":    {2, 1},
-		"render_background":      {3, 1},
-		"render_sprites":         {4, 1},
-		"enhance_red":            {5, 1},
-		"enhance_green":          {6, 1},
-		"enhance_blue":           {7, 1},
+		"grayscale":              {Index: 0, Size: 1},
+		"render_background_left": {Index: 1, Size: 1},
+		"render_sprites_left":    {Index: 2, Size: 1},
+		"render_background":      {Index: 3, Size: 1},
+		"render_sprites":         {Index: 4, Size: 1},
+		"enhance_red":            {Index: 5, Size: 1},
+		"enhance_green":          {Index: 6, Size: 1},
+		"enhance_blue":           {Index: 7, Size: 1},
 	})
 }
 
 func CreateControlRegister() ppu.Register {
 	return ppu.CreateRegister(map[string]ppu.Field{
-		"nametable_x":        {0, 1},
-		"nametable_y":        {1, 1},
-		"increment_mode":     {2, 1},
-		"pattern_sprite":     {3, 1},
-		"pattern_background": {4, 1},
-		"sprite_size":        {5, 1},
-		"slave_mode":         {6, 1},
-		"enable_nmi":         {7, 1},
+		"nametable_x":        {Index: 0, Size: 1},
+		"nametable_y":        {Index: 1, Size: 1},
+		"increment_mode":     {Index: 2, Size: 1},
+		"pattern_sprite":     {Index: 3, Size: 1},
+		"pattern_background": {Index: 4, Size: 1},
+		"sprite_size":        {Index: 5, Size: 1},
+		"slave_mode":         {Index: 6, Size: 1},
+		"enable_nmi":         {Index: 7, Size: 1},
 	})
 }
 
 func CreateLoopyRegister() ppu.Register {
 	return ppu.CreateRegister(map[string]ppu.Field{
-		"coarse_x":    {0, 5},
-		"coarse_y":    {5, 5},
-		"nametable_x": {10, 1},
-		"nametable_y": {11, 1},
-		"fine_y":      {12, 3},
-		"unused":      {15, 1},
+		"coarse_x":    {Index: 0, Size: 5},
+		"coarse_y":    {Index: 5, Size: 5},
+		"nametable_x": {Index: 10, Size: 1},
+		"nametable_y": {Index: 11, Size: 1},
+		"fine_y":      {Index: 12, Size: 3},
+		"unused":      {Index: 15, Size: 1},
 	})
 }
 
@@ -94,6 +96,8 @@ type PPU struct {
 	scanline      int16
 	cycle         int16
 	frameComplete bool
+	// frame counts the frames completed since power on
+	frame uint64
 
 	bgNextTileId       uint8
 	bgNextTileAttrib   uint8
@@ -105,10 +109,12 @@ type PPU struct {
 	bgShifterAttribHi  uint16
 
 	cartridge *Cartridge
-	nmi       bool
-	oam       [64]ObjectAttributeEntry
-	oamAddr   uint8
-	oamPtr    unsafe.Pointer
+	// nmi is the level of the NMI output: asserted while in vertical blank
+	// with NMIs enabled. The CPU reacts to it going up.
+	nmi     bool
+	oam     [64]ObjectAttributeEntry
+	oamAddr uint8
+	oamPtr  unsafe.Pointer
 
 	spriteScanline         [8]ObjectAttributeEntry
 	spriteCount            uint8
@@ -124,30 +130,55 @@ func (p *PPU) connectCartridge(cartridge *Cartridge) {
 	p.cartridge = cartridge
 }
 
+//go:embed palette.json
+var paletteJSON []byte
+
 func loadPalette() []color.Color {
-	jsonFile, err := os.Open("palette.json")
-	// if we os.Open returns an error then handle it
+	palette, err := parsePalette(paletteJSON)
 	if err != nil {
-		fmt.Println(err)
+		panic(err)
 	}
-	fmt.Println("Successfully Opened palette.json")
-	// defer the closing of our jsonFile so that we can parse it later on
-	defer jsonFile.Close()
-
-	byteValue, _ := io.ReadAll(jsonFile)
+	return palette
+}
 
+// parsePalette reads a palette as a JSON list of [r, g, b] triplets.
+func parsePalette(data []byte) ([]color.Color, error) {
 	var result [][3]uint8
-	errJson := json.Unmarshal(byteValue, &result)
-	if errJson != nil {
-		panic(errJson)
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if len(result) < 64 {
+		return nil, fmt.Errorf("palette has %d colours, want 64", len(result))
 	}
 
 	palette := make([]color.Color, 64)
-	for i := 0; i < len(result); i++ {
+	for i := 0; i < len(palette); i++ {
 		palette[i] = color.RGBA{R: result[i][0], G: result[i][1], B: result[i][2], A: 0xFF}
 	}
-	return palette
+	return palette, nil
+}
 
+// LoadPalette reads a palette file to use instead of the built-in one.
+// Files ending in .json hold [r, g, b] triplets like palette.json; anything
+// else is taken as the raw .pal format most palette generators write, 64
+// (or 512, with the emphasis variants, which are ignored) RGB triplets.
+func LoadPalette(filename string) ([]color.Color, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		return parsePalette(data)
+	}
+
+	if len(data) != 64*3 && len(data) != 512*3 {
+		return nil, fmt.Errorf("%s: %d bytes is not a 64 or 512 colour palette", filename, len(data))
+	}
+	palette := make([]color.Color, 64)
+	for i := 0; i < len(palette); i++ {
+		palette[i] = color.RGBA{R: data[i*3], G: data[i*3+1], B: data[i*3+2], A: 0xFF}
+	}
+	return palette, nil
 }
 
 func (p *PPU) cpuRead(addr uint16, readOnly bool) uint8 {
@@ -168,6 +199,7 @@ func (p *PPU) cpuRead(addr uint16, readOnly bool) uint8 {
 	case 0x0002:
 		data = (uint8(p.status.Reg) & 0xE0) | (uint8(p.ppuDataBuffer) & 0x1F)
 		p.status.SetField("vertical_blank", 0)
+		p.updateNMI()
 		p.addressLatch = 0
 	case 0x0004:
 		pointer := unsafe.Add(p.oamPtr, uintptr(p.oamAddr)*unsafe.Sizeof(p.oam[0].y))
@@ -194,6 +226,7 @@ func (p *PPU) cpuWrite(addr uint16, data uint8) {
 	switch addr {
 	case 0x0000:
 		p.control.SetReg(uint16(data))
+		p.updateNMI()
 		p.tramAddr.SetField("nametable_x", p.control.GetField("nametable_x"))
 		p.tramAddr.SetField("nametable_y", p.control.GetField("nametable_y"))
 	case 0x0001:
@@ -279,6 +312,14 @@ func (p *PPU) ppuRead(addr uint16, readOnly bool) uint8 {
 			}
 			return data
 		}
+
+		if p.cartridge.Mirror() == mapper.ONESCREEN_LO {
+			return p.tableName[0][addr&0x03FF]
+		}
+
+		if p.cartridge.Mirror() == mapper.ONESCREEN_HI {
+			return p.tableName[1][addr&0x03FF]
+		}
 	}
 
 	if addr >= 0x3F00 && addr <= 0x3FFF {
@@ -348,6 +389,14 @@ func (p *PPU) ppuWrite(addr uint16, data uint8) {
 			}
 			return
 		}
+		if p.cartridge.Mirror() == mapper.ONESCREEN_LO {
+			p.tableName[0][addr&0x03FF] = data
+			return
+		}
+		if p.cartridge.Mirror() == mapper.ONESCREEN_HI {
+			p.tableName[1][addr&0x03FF] = data
+			return
+		}
 	}
 	if addr >= 0x3F00 && addr <= 0x3FFF {
 		addr &= 0x001F
@@ -397,7 +446,7 @@ func (p *PPU) getPatternTable(i uint8, palette uint8) image.RGBA {
 	return *(p.sprPatternTable[i])
 }
 
-func NewPPU(lock sync.Mutex) *PPU {
+func NewPPU() *PPU {
 
 	mPPU := &PPU{
 		palScreen:   loadPalette(),
@@ -432,7 +481,6 @@ func NewPPU(lock sync.Mutex) *PPU {
 		addressLatch:       0,
 		ppuDataBuffer:      0,
 		nmi:                false,
-		outputLock:         lock,
 	}
 	mPPU.oamPtr = unsafe.Pointer(&(mPPU.oam[0]))
 	for y := 0; y < 240; y++ {
@@ -621,12 +669,16 @@ func (p *PPU) clock() {
 	//}
 
 	if p.scanline >= -1 && p.scanline < 240 {
-		if p.scanline == 0 && p.cycle == 0 {
+		// Odd frames are one dot shorter while rendering, the idle dot of
+		// the first line is skipped
+		if p.scanline == 0 && p.cycle == 0 && p.frame%2 == 1 &&
+			(p.mask.GetField("render_background") != 0 || p.mask.GetField("render_sprites") != 0) {
 			p.cycle = 1
 		}
 
 		if p.scanline == -1 && p.cycle == 1 {
 			p.status.SetField("vertical_blank", 0)
+			p.updateNMI()
 			p.status.SetField("sprite_zero_hit", 0)
 			p.status.SetField("sprite_overflow", 0)
 			for i := 0; i < 8; i++ {
@@ -672,6 +724,12 @@ func (p *PPU) clock() {
 			p.TransferAddressY()
 		}
 
+		// Boards like the MMC3 count scanlines by watching the PPU address
+		// bus, which only toggles the way they expect while rendering
+		if p.cycle == 260 && (p.mask.GetField("render_background") != 0 || p.mask.GetField("render_sprites") != 0) {
+			p.cartridge.scanline()
+		}
+
 		// Foreground rendering ===================
 		if p.cycle == 257 && p.scanline >= 0 {
 			for i := range p.spriteScanline {
@@ -799,9 +857,7 @@ func (p *PPU) clock() {
 	if p.scanline >= 241 && p.scanline < 261 {
 		if p.scanline == 241 && p.cycle == 1 {
 			p.status.SetField("vertical_blank", 1)
-			if p.control.GetField("enable_nmi") != 0 {
-				p.nmi = true
-			}
+			p.updateNMI()
 		}
 	}
 
@@ -928,10 +984,20 @@ func (p *PPU) clock() {
 			p.outputLock.Unlock()
 
 			p.frameComplete = true
+			p.frame++
 		}
 	}
 }
 
+// clearMemory empties the nametables, the palette and OAM, which a reset
+// leaves alone.
+func (p *PPU) clearMemory() {
+	p.tableName = [2][1024]uint8{}
+	p.tablePalette = [32]uint8{}
+	p.oam = [64]ObjectAttributeEntry{}
+	p.oamAddr = 0
+}
+
 func (p *PPU) reset() {
 	p.fineX = 0
 	p.addressLatch = 0
@@ -951,4 +1017,12 @@ func (p *PPU) reset() {
 	p.control.SetReg(0x00)
 	p.vramAddr.SetReg(0x00)
 	p.tramAddr.SetReg(0x00)
+	p.updateNMI()
+}
+
+// updateNMI recomputes the NMI output after the vertical blank flag or the
+// NMI enable bit changed. Enabling NMIs during vertical blank raises it
+// again, which gives the CPU another NMI.
+func (p *PPU) updateNMI() {
+	p.nmi = p.status.GetField("vertical_blank") != 0 && p.control.GetField("enable_nmi") != 0
 }
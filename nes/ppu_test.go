@@ -0,0 +1,30 @@
+package nes
+
+import (
+	"github.com/stretchr/testify/assert"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPalette(t *testing.T) {
+	assert.Equal(t, 64, len(loadPalette()))
+
+	raw := make([]byte, 64*3)
+	raw[3*0x21+0], raw[3*0x21+1], raw[3*0x21+2] = 0x10, 0x20, 0x30
+	palPath := filepath.Join(t.TempDir(), "custom.pal")
+	assert.NoError(t, os.WriteFile(palPath, raw, 0644))
+	palette, err := LoadPalette(palPath)
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xFF}, palette[0x21])
+
+	assert.NoError(t, os.WriteFile(palPath, raw[:100], 0644))
+	_, err = LoadPalette(palPath)
+	assert.Error(t, err)
+
+	jsonPath := filepath.Join(t.TempDir(), "custom.json")
+	assert.NoError(t, os.WriteFile(jsonPath, []byte("[[1, 2, 3]]"), 0644))
+	_, err = LoadPalette(jsonPath)
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+package nes
+
+import "math"
+
+// The APU output is resampled with band-limited step synthesis: every
+// change of the mixed level is added to the output as a windowed-sinc step
+// placed with sub-sample precision, so tones above the host's Nyquist
+// frequency are filtered out instead of aliasing.
+const (
+	blipTaps   = 32   // kernel width, in output samples
+	blipPhases = 64   // sub-sample positions
+	blipCutoff = 0.45 // of the output rate
+)
+
+// blipKernel is the band-limited impulse for each sub-sample position,
+// normalised so that steps keep their height.
+var blipKernel = makeBlipKernel()
+
+func makeBlipKernel() (kernel [blipPhases][blipTaps]float64) {
+	for phase := range kernel {
+		t := float64(phase) / blipPhases
+		sum := 0.0
+		for i := range kernel[phase] {
+			x := float64(i+1) - t - blipTaps/2
+			sinc := 2 * blipCutoff
+			if x != 0 {
+				sinc = math.Sin(2*math.Pi*blipCutoff*x) / (math.Pi * x)
+			}
+			// Blackman window, zero at both ends
+			window := 0.42 + 0.5*math.Cos(2*math.Pi*x/blipTaps) + 0.08*math.Cos(4*math.Pi*x/blipTaps)
+			kernel[phase][i] = sinc * window
+			sum += kernel[phase][i]
+		}
+		for i := range kernel[phase] {
+			kernel[phase][i] /= sum
+		}
+	}
+	return kernel
+}
+
+// resampler turns level changes at the CPU clock into samples at the host
+// rate. buf holds the impulses of the changes not yet output, buf[0] being
+// the next sample; time is where the current clock falls after it, in
+// samples. The output is the running sum of the impulses, delayed by half
+// the kernel.
+type resampler struct {
+	ratio      float64
+	baseRatio  float64
+	time       float64
+	buf        [blipTaps + 1]float64
+	integrator float64
+	filters    []filter
+	emit       func(sample float32)
+}
+
+// setRates makes clockRate clocks produce sampleRate samples through the
+// filters of the console's audio output: two high-passes at 90 and 440 Hz
+// and a low-pass at 14 kHz. A zero sampleRate turns the output off.
+func (r *resampler) setRates(clockRate float64, sampleRate float64) {
+	r.baseRatio = sampleRate / clockRate
+	r.ratio = r.baseRatio
+	r.filters = []filter{
+		newHighPass(90, sampleRate),
+		newHighPass(440, sampleRate),
+		newLowPass(14000, sampleRate),
+	}
+}
+
+// bend scales the output rate by factor, leaving the filters as they are.
+func (r *resampler) bend(factor float64) {
+	r.ratio = r.baseRatio * factor
+}
+
+// addDelta changes the level at the current clock.
+func (r *resampler) addDelta(delta float64) {
+	if r.ratio == 0 {
+		return
+	}
+	kernel := &blipKernel[int(r.time*blipPhases)]
+	for i, k := range kernel {
+		r.buf[i+1] += delta * k
+	}
+}
+
+// clock moves on to the next clock, emitting the samples completed.
+func (r *resampler) clock() {
+	if r.ratio == 0 {
+		return
+	}
+	r.time += r.ratio
+	for r.time >= 1 {
+		r.time -= 1
+		r.integrator += r.buf[0]
+		copy(r.buf[:], r.buf[1:])
+		r.buf[blipTaps] = 0
+
+		sample := r.integrator
+		for i := range r.filters {
+			sample = r.filters[i].apply(sample)
+		}
+		if r.emit != nil {
+			r.emit(float32(sample))
+		}
+	}
+}
+
+// filter is a first-order high-pass or low-pass filter, like the RC stages
+// between the APU and the console's audio output.
+type filter struct {
+	highPass bool
+	alpha    float64
+	prevIn   float64
+	prevOut  float64
+}
+
+func newHighPass(cutoff float64, sampleRate float64) filter {
+	rc := 1 / (2 * math.Pi * cutoff)
+	return filter{highPass: true, alpha: rc / (rc + 1/sampleRate)}
+}
+
+func newLowPass(cutoff float64, sampleRate float64) filter {
+	rc := 1 / (2 * math.Pi * cutoff)
+	dt := 1 / sampleRate
+	return filter{alpha: dt / (rc + dt)}
+}
+
+func (f *filter) apply(in float64) float64 {
+	if f.highPass {
+		f.prevOut = f.alpha * (f.prevOut + in - f.prevIn)
+	} else {
+		f.prevOut += f.alpha * (in - f.prevOut)
+	}
+	f.prevIn = in
+	return f.prevOut
+}
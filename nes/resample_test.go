@@ -0,0 +1,83 @@
+package nes
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+// newTestResampler has no filters, so steps are kept as they are.
+func newTestResampler(clockRate float64, sampleRate float64, samples *[]float64) *resampler {
+	return &resampler{
+		ratio: sampleRate / clockRate,
+		emit: func(sample float32) {
+			*samples = append(*samples, float64(sample))
+		},
+	}
+}
+
+func TestResamplerStep(t *testing.T) {
+	var samples []float64
+	r := newTestResampler(cpuFrequency, 44100, &samples)
+	for i := 0; i < 1000; i++ {
+		if i == 500 {
+			r.addDelta(0.5)
+		}
+		r.clock()
+	}
+	// 1000 clocks are 24.6 samples
+	assert.Len(t, samples, 24)
+	for i := 0; i < 100000; i++ {
+		r.clock()
+	}
+	assert.InDelta(t, 0.5, samples[len(samples)-1], 1e-6)
+	for _, sample := range samples[:5] {
+		assert.Zero(t, sample)
+	}
+}
+
+func TestResamplerAliasing(t *testing.T) {
+	// A 30 kHz square wave is above what 44.1 kHz can hold, only its
+	// average should come out
+	var samples []float64
+	r := newTestResampler(cpuFrequency, 44100, &samples)
+	halfPeriod := 30 // 29.8 kHz
+	level := 0.0
+	for i := 0; i < 200000; i++ {
+		if i%halfPeriod == 0 {
+			delta := 1 - 2*level
+			r.addDelta(delta)
+			level += delta
+		}
+		r.clock()
+	}
+	worst := 0.0
+	for _, sample := range samples[100:] {
+		worst = math.Max(worst, math.Abs(sample-0.5))
+	}
+	assert.Less(t, worst, 0.02)
+}
+
+func TestFilters(t *testing.T) {
+	// The high-pass removes DC, the low-pass keeps it
+	highPass := newHighPass(90, 44100)
+	lowPass := newLowPass(14000, 44100)
+	var high, low float64
+	for i := 0; i < 44100; i++ {
+		high = highPass.apply(1)
+		low = lowPass.apply(1)
+	}
+	assert.InDelta(t, 0, high, 1e-6)
+	assert.InDelta(t, 1, low, 1e-6)
+}
+
+func TestMixer(t *testing.T) {
+	// At power up only the triangle, resting on its first step, outputs
+	apu := NewAPU()
+	assert.Equal(t, tndTable[3*15], apu.mix())
+	// Pulses at full volume, then every other channel at its maximum
+	assert.InDelta(t, 0.2575, pulseTable[30], 1e-4)
+	assert.InDelta(t, 0.7425, tndTable[202], 1e-4)
+	// The mixer compresses: two pulses are less than twice one
+	assert.Less(t, pulseTable[30], 2*pulseTable[15])
+}
@@ -0,0 +1,203 @@
+package nes
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// Rewind keeps the recent history of a console in memory, as save states
+// taken every few frames. The newest snapshot is kept as is; every older
+// one is stored as the XOR with the snapshot that follows it, compressed.
+// Most of the machine doesn't change between two frames, so the deltas are
+// small, and since they point forward in time the oldest one can always be
+// dropped to stay within the memory budget.
+type Rewind struct {
+	console  *Console
+	interval int
+	budget   int
+
+	frames int
+	latest []byte
+	loaded bool
+	deltas deltaRing
+	used   int
+
+	compressed bytes.Buffer
+	compressor *flate.Writer
+}
+
+// NewRewind records the history of console, a snapshot every interval
+// frames, using at most budget bytes.
+func NewRewind(console *Console, interval int, budget int) *Rewind {
+	if interval < 1 {
+		interval = 1
+	}
+	// BestSpeed never fails to build
+	compressor, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &Rewind{
+		console:    console,
+		interval:   interval,
+		budget:     budget,
+		compressor: compressor,
+	}
+}
+
+// Interval is the number of frames between snapshots.
+func (r *Rewind) Interval() int {
+	return r.interval
+}
+
+// Len is the number of snapshots in the history.
+func (r *Rewind) Len() int {
+	if r.latest == nil {
+		return 0
+	}
+	return r.deltas.len() + 1
+}
+
+// Size is the memory used by the history, in bytes.
+func (r *Rewind) Size() int {
+	return r.used + len(r.latest)
+}
+
+// Clear forgets the whole history, for when a different game is loaded.
+func (r *Rewind) Clear() {
+	r.frames = 0
+	r.latest = nil
+	r.loaded = false
+	r.deltas = deltaRing{}
+	r.used = 0
+}
+
+// Record has to be called after every frame played forward. It takes a
+// snapshot every interval frames.
+func (r *Rewind) Record() error {
+	r.loaded = false
+	r.frames++
+	if r.latest != nil && r.frames < r.interval {
+		return nil
+	}
+	r.frames = 0
+
+	var state bytes.Buffer
+	if err := r.console.SaveState(&state); err != nil {
+		return err
+	}
+	if r.latest == nil || len(r.latest) != state.Len() {
+		r.Clear()
+	} else {
+		delta, err := r.compress(r.latest, state.Bytes())
+		if err != nil {
+			return err
+		}
+		r.deltas.push(delta)
+		r.used += len(delta)
+	}
+	r.latest = state.Bytes()
+
+	for r.Size() > r.budget && r.deltas.len() > 0 {
+		r.used -= len(r.deltas.popOldest())
+	}
+	return nil
+}
+
+// Step takes the console one snapshot back in time. The first call goes
+// back to the newest snapshot, later ones further back. It returns false
+// once the oldest snapshot has been reached, which further calls keep
+// restoring. A movie being recorded counts one rerecord per rewind, the
+// frames after the snapshot are recorded again as the game goes on.
+func (r *Rewind) Step() (bool, error) {
+	if r.latest == nil {
+		return false, nil
+	}
+	if !r.loaded {
+		r.console.movieRewound()
+	}
+	if r.loaded && r.deltas.len() > 0 {
+		delta := r.deltas.popNewest()
+		r.used -= len(delta)
+		previous, err := r.decompress(delta, r.latest)
+		if err != nil {
+			return false, err
+		}
+		r.latest = previous
+	}
+	if err := r.console.restoreState(bytes.NewReader(r.latest)); err != nil {
+		return false, err
+	}
+	r.loaded = true
+	r.frames = 0
+	return r.deltas.len() > 0, nil
+}
+
+func (r *Rewind) compress(older []byte, newer []byte) ([]byte, error) {
+	delta := make([]byte, len(older))
+	for i := range delta {
+		delta[i] = older[i] ^ newer[i]
+	}
+	r.compressed.Reset()
+	r.compressor.Reset(&r.compressed)
+	if _, err := r.compressor.Write(delta); err != nil {
+		return nil, err
+	}
+	if err := r.compressor.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), r.compressed.Bytes()...), nil
+}
+
+func (r *Rewind) decompress(delta []byte, newer []byte) ([]byte, error) {
+	older := make([]byte, len(newer))
+	reader := flate.NewReader(bytes.NewReader(delta))
+	defer reader.Close()
+	if _, err := io.ReadFull(reader, older); err != nil {
+		return nil, err
+	}
+	for i := range older {
+		older[i] ^= newer[i]
+	}
+	return older, nil
+}
+
+// deltaRing is a queue of deltas that grows as needed and is consumed from
+// both ends: rewinding takes the newest, the memory budget drops the
+// oldest.
+type deltaRing struct {
+	items [][]byte
+	head  int
+	count int
+}
+
+func (q *deltaRing) len() int {
+	return q.count
+}
+
+func (q *deltaRing) push(delta []byte) {
+	if q.count == len(q.items) {
+		items := make([][]byte, 2*len(q.items)+16)
+		for i := 0; i < q.count; i++ {
+			items[i] = q.items[(q.head+i)%len(q.items)]
+		}
+		q.items = items
+		q.head = 0
+	}
+	q.items[(q.head+q.count)%len(q.items)] = delta
+	q.count++
+}
+
+func (q *deltaRing) popOldest() []byte {
+	delta := q.items[q.head]
+	q.items[q.head] = nil
+	q.head = (q.head + 1) % len(q.items)
+	q.count--
+	return delta
+}
+
+func (q *deltaRing) popNewest() []byte {
+	i := (q.head + q.count - 1) % len(q.items)
+	delta := q.items[i]
+	q.items[i] = nil
+	q.count--
+	return delta
+}
@@ -0,0 +1,117 @@
+package nes
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func saveState(t *testing.T, console *Console) []byte {
+	var state bytes.Buffer
+	assert.NoError(t, console.SaveState(&state))
+	return state.Bytes()
+}
+
+func TestRewind(t *testing.T) {
+	console := newStateConsole(t)
+	rewind := NewRewind(console, 1, 1<<20)
+
+	var history [][]byte
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, console.StepFrame())
+		assert.NoError(t, rewind.Record())
+		history = append(history, saveState(t, console))
+	}
+	assert.Equal(t, 10, rewind.Len())
+
+	for i := 9; i >= 0; i-- {
+		more, err := rewind.Step()
+		assert.NoError(t, err)
+		assert.Equal(t, i > 0, more)
+		assert.Equal(t, history[i], saveState(t, console), "snapshot %d", i)
+		// Rewinding plays a frame from the snapshot to show it
+		assert.NoError(t, console.StepFrame())
+	}
+
+	// The oldest snapshot stays available
+	more, err := rewind.Step()
+	assert.NoError(t, err)
+	assert.False(t, more)
+	assert.Equal(t, history[0], saveState(t, console))
+}
+
+func TestRewindResume(t *testing.T) {
+	console := newStateConsole(t)
+	rewind := NewRewind(console, 2, 1<<20)
+
+	var history [][]byte
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, console.StepFrame())
+		assert.NoError(t, rewind.Record())
+		history = append(history, saveState(t, console))
+	}
+	// Snapshots after frames 1, 3 and 5
+	assert.Equal(t, 3, rewind.Len())
+	_, err := rewind.Step()
+	assert.NoError(t, err)
+	_, err = rewind.Step()
+	assert.NoError(t, err)
+	assert.Equal(t, history[2], saveState(t, console))
+
+	// Playing again keeps the snapshot the game resumed from
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, console.StepFrame())
+		assert.NoError(t, rewind.Record())
+	}
+	resumed := saveState(t, console)
+	assert.Equal(t, 3, rewind.Len())
+	_, err = rewind.Step()
+	assert.NoError(t, err)
+	assert.Equal(t, resumed, saveState(t, console))
+	_, err = rewind.Step()
+	assert.NoError(t, err)
+	assert.Equal(t, history[2], saveState(t, console))
+}
+
+func TestRewindBudget(t *testing.T) {
+	console := newStateConsole(t)
+	assert.NoError(t, console.StepFrame())
+	size := len(saveState(t, console))
+
+	rewind := NewRewind(console, 1, size+size/10)
+	for i := 0; i < 30; i++ {
+		assert.NoError(t, console.StepFrame())
+		assert.NoError(t, rewind.Record())
+		assert.LessOrEqual(t, rewind.Size(), size+size/10)
+	}
+	// Deltas are much smaller than whole states
+	assert.Greater(t, rewind.Len(), 2)
+	assert.Less(t, rewind.Len(), 30)
+}
+
+func TestRewindSideEffects(t *testing.T) {
+	console := newMovieConsole(t)
+	movie := &Movie{}
+	assert.NoError(t, console.RecordMovie(movie))
+	rewind := NewRewind(console, 1, 1<<20)
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, console.StepFrame())
+		assert.NoError(t, rewind.Record())
+	}
+	console.bus.cartridge.prgRamDirty = false
+
+	// Rewinding neither marks the battery RAM for saving nor cuts the
+	// movie at every step, it counts as a single rerecord
+	for i := 0; i < 3; i++ {
+		_, err := rewind.Step()
+		assert.NoError(t, err)
+	}
+	assert.False(t, console.bus.cartridge.prgRamDirty)
+	assert.True(t, console.Recording())
+	assert.Len(t, movie.Frames, 6)
+	assert.Equal(t, 1, movie.RerecordCount)
+
+	// Playing on records over the frames rewound
+	assert.NoError(t, console.StepFrame())
+	assert.Len(t, movie.Frames, 5)
+}
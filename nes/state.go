@@ -0,0 +1,245 @@
+package nes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+var (
+	ErrInvalidState  = errors.New("state: not a save state")
+	ErrStateVersion  = errors.New("state: unsupported format version")
+	ErrStateMismatch = errors.New("state: saved with a different ROM")
+	ErrNoCartridge   = errors.New("state: no cartridge loaded")
+)
+
+// Save states start with a stateHeader, followed by the state of the CPU,
+// the bus, the PPU, the APU, the cartridge memory and the mapper, in that
+// order. Components list their fields as pointers to fixed-size values (or
+// byte slices), written little endian with no padding. Changing any of the
+// lists means bumping stateVersion.
+const stateVersion = 8
+
+var stateMagic = [4]byte{'N', 'E', 'S', 'S'}
+
+type stateHeader struct {
+	Magic   [4]byte
+	Version uint16
+	ROMHash [sha256.Size]byte
+}
+
+func writeFields(w io.Writer, fields []interface{}) error {
+	for _, field := range fields {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFields(r io.Reader, fields []interface{}) error {
+	for _, field := range fields {
+		if err := binary.Read(r, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CPU) state() []interface{} {
+	return []interface{}{
+		&c.accumulator, &c.xRegister, &c.yRegister, &c.stkp, &c.pc, &c.status,
+		&c.fetched, &c.addrAbs, &c.addrRel, &c.previousOpcode, &c.previousPc, &c.opcode,
+		&c.jammed, &c.cycleCount,
+		&c.step, &c.addressed, &c.operandRead, &c.operandCycle, &c.interrupt,
+		&c.nmiLine, &c.nmiPrevLine, &c.needNmi, &c.prevNeedNmi,
+		&c.irqLines, &c.runIrq, &c.prevRunIrq,
+	}
+}
+
+// The buttons held on the controllers, turbo included, aren't saved, they
+// belong to the frontend.
+func (b *Bus) state() []interface{} {
+	return []interface{}{
+		&b.systemClockCounter, b.cpuRam, &b.controllerState, &b.controllerStrobe, &b.openBus,
+		&b.dmaPage, &b.dmaAddr, &b.dmaData, &b.dmaTransfer, &b.dmaDummy, &b.dmcStall,
+	}
+}
+
+// OAM is saved through the byte view $2004 and DMA use. States are always
+// loaded in place, so oamPtr stays valid. Only the register values are
+// saved, restoreRegisters rebuilds their fields after loading.
+func (p *PPU) state() []interface{} {
+	return []interface{}{
+		p.tableName[0][:], p.tableName[1][:], p.tablePattern[0][:], p.tablePattern[1][:], p.tablePalette[:],
+		&p.status.Reg, &p.mask.Reg, &p.control.Reg, &p.vramAddr.Reg, &p.tramAddr.Reg,
+		&p.fineX, &p.addressLatch, &p.ppuDataBuffer,
+		&p.scanline, &p.cycle, &p.frameComplete, &p.frame,
+		&p.bgNextTileId, &p.bgNextTileAttrib, &p.bgNextTileLsb, &p.bgNextTileMsb,
+		&p.bgShifterPatternLo, &p.bgShifterPatternHi, &p.bgShifterAttribLo, &p.bgShifterAttribHi,
+		&p.nmi,
+		unsafe.Slice((*uint8)(p.oamPtr), unsafe.Sizeof(p.oam)), &p.oamAddr,
+		unsafe.Slice((*uint8)(unsafe.Pointer(&p.spriteScanline[0])), unsafe.Sizeof(p.spriteScanline)),
+		&p.spriteCount, p.spriteShifterPatternLo[:], p.spriteShifterPatternHi[:],
+		&p.spriteZeroHitPossible, &p.spriteZeroBeingRendered,
+	}
+}
+
+func (p *PPU) restoreRegisters() {
+	p.status.SetReg(p.status.Reg)
+	p.mask.SetReg(p.mask.Reg)
+	p.control.SetReg(p.control.Reg)
+	p.vramAddr.SetReg(p.vramAddr.Reg)
+	p.tramAddr.SetReg(p.tramAddr.Reg)
+}
+
+func (l *lengthCounter) state() []interface{} {
+	return []interface{}{&l.enable, &l.halt, &l.counter}
+}
+
+func (e *envelope) state() []interface{} {
+	return []interface{}{&e.start, &e.loop, &e.constant, &e.period, &e.divider, &e.decay}
+}
+
+func (p *pulse) state() []interface{} {
+	fields := []interface{}{
+		&p.duty, &p.period, &p.timer, &p.step,
+		&p.sweep.enable, &p.sweep.period, &p.sweep.negate, &p.sweep.shift, &p.sweep.divider, &p.sweep.reload,
+	}
+	fields = append(fields, p.length.state()...)
+	return append(fields, p.envelope.state()...)
+}
+
+func (t *triangle) state() []interface{} {
+	return append(t.length.state(),
+		&t.control, &t.linearReload, &t.linearCounter, &t.linearReloadFlag,
+		&t.period, &t.timer, &t.step,
+	)
+}
+
+func (n *noise) state() []interface{} {
+	fields := []interface{}{&n.mode, &n.period, &n.timer, &n.shift}
+	fields = append(fields, n.length.state()...)
+	return append(fields, n.envelope.state()...)
+}
+
+func (d *dmc) state() []interface{} {
+	return []interface{}{
+		&d.irqEnable, &d.loop, &d.rate, &d.timer, &d.level,
+		&d.sampleAddress, &d.sampleLength, &d.address, &d.bytesRemaining,
+		&d.buffer, &d.bufferFull, &d.shift, &d.bitsRemaining, &d.silence, &d.irq,
+	}
+}
+
+// The noise and DMC tables follow the cartridge, they aren't saved. Neither
+// is the resampler, it depends on the host's rate.
+func (a *APU) state() []interface{} {
+	fields := []interface{}{
+		&a.clockCounter, &a.frameClockCounter, &a.frameResetDelay,
+		&a.fiveStepMode, &a.irqInhibit, &a.frameIRQ,
+	}
+	fields = append(fields, a.pulse[0].state()...)
+	fields = append(fields, a.pulse[1].state()...)
+	fields = append(fields, a.triangle.state()...)
+	fields = append(fields, a.noise.state()...)
+	return append(fields, a.dmc.state()...)
+}
+
+// CHR is only saved when it's RAM. The mapper saves its own registers.
+func (c *Cartridge) state() []interface{} {
+	fields := []interface{}{c.prgRam}
+	if c.info.ChrRomSize == 0 {
+		fields = append(fields, c.chrMemory)
+	}
+	return fields
+}
+
+func (c *Console) state() []interface{} {
+	var fields []interface{}
+	fields = append(fields, c.cpu.state()...)
+	fields = append(fields, c.bus.state()...)
+	fields = append(fields, c.ppu.state()...)
+	fields = append(fields, c.apu.state()...)
+	return append(fields, c.bus.cartridge.state()...)
+}
+
+func (c *Console) saveComponents(w io.Writer) error {
+	if err := writeFields(w, c.state()); err != nil {
+		return err
+	}
+	return c.bus.cartridge.mapper.SaveState(w)
+}
+
+func (c *Console) loadComponents(r io.Reader) error {
+	defer c.ppu.restoreRegisters()
+	if err := readFields(r, c.state()); err != nil {
+		return err
+	}
+	return c.bus.cartridge.mapper.LoadState(r)
+}
+
+// SaveState writes a snapshot of the whole machine to w: every component,
+// cartridge RAM and mapper registers included. The buttons held aren't
+// part of it. w should be buffered.
+func (c *Console) SaveState(w io.Writer) error {
+	cart := c.bus.cartridge
+	if cart == nil {
+		return ErrNoCartridge
+	}
+	header := stateHeader{Magic: stateMagic, Version: stateVersion, ROMHash: cart.hash}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	return c.saveComponents(w)
+}
+
+// LoadState restores a snapshot written by SaveState. States saved with
+// another ROM are rejected with ErrStateMismatch, and states from another
+// version of the format with ErrStateVersion, wrapped. When loading fails
+// the console is left as it was. Movies follow the state, see PlayMovie.
+func (c *Console) LoadState(r io.Reader) error {
+	if err := c.restoreState(r); err != nil {
+		return err
+	}
+	// Battery RAM may differ from what's on disk now
+	c.bus.cartridge.prgRamDirty = true
+	c.movieStateLoaded()
+	return nil
+}
+
+// restoreState is LoadState for the console's own snapshots, like rewind's:
+// the battery RAM isn't marked for saving and a movie isn't told.
+func (c *Console) restoreState(r io.Reader) error {
+	cart := c.bus.cartridge
+	if cart == nil {
+		return ErrNoCartridge
+	}
+	header := stateHeader{}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if header.Magic != stateMagic {
+		return fmt.Errorf("%w: bad magic % x", ErrInvalidState, header.Magic)
+	}
+	if header.Version != stateVersion {
+		return fmt.Errorf("%w: %d", ErrStateVersion, header.Version)
+	}
+	if header.ROMHash != cart.hash {
+		return ErrStateMismatch
+	}
+
+	var backup bytes.Buffer
+	if err := c.saveComponents(&backup); err != nil {
+		return err
+	}
+	if err := c.loadComponents(r); err != nil {
+		// Undo whatever was read before the error
+		_ = c.loadComponents(&backup)
+		return fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	return nil
+}
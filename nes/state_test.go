@@ -0,0 +1,79 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newStateConsole runs a program that counts in RAM and takes NMIs, so
+// frames differ from each other.
+func newStateConsole(t *testing.T) *Console {
+	console := newTestConsole(t, []byte{
+		0xA9, 0x80, // LDA #$80
+		0x8D, 0x00, 0x20, // STA $2000
+		0xE8,             // INX
+		0x8E, 0x00, 0x02, // STX $0200
+		0xEE, 0x01, 0x02, // INC $0201
+		0x4C, 0x05, 0xC0, // JMP $C005
+		0x40, // RTI
+	})
+	console.bus.cartridge.prgMemory[0x3FFA] = 0x0F
+	console.bus.cartridge.prgMemory[0x3FFB] = 0xC0
+	return console
+}
+
+func TestSaveState(t *testing.T) {
+	console := newStateConsole(t)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, console.StepFrame())
+	}
+	var state bytes.Buffer
+	assert.NoError(t, console.SaveState(&state))
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, console.StepFrame())
+	}
+	var expected bytes.Buffer
+	assert.NoError(t, console.SaveState(&expected))
+
+	// Running again from the state gives exactly the same machine
+	assert.NoError(t, console.LoadState(bytes.NewReader(state.Bytes())))
+	assert.Equal(t, uint16(1), console.ppu.control.GetField("enable_nmi"))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, console.StepFrame())
+	}
+	var actual bytes.Buffer
+	assert.NoError(t, console.SaveState(&actual))
+	assert.Equal(t, expected.Bytes(), actual.Bytes())
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	console := newStateConsole(t)
+	assert.NoError(t, console.StepFrame())
+	var state bytes.Buffer
+	assert.NoError(t, console.SaveState(&state))
+	assert.NoError(t, console.StepFrame())
+	var current bytes.Buffer
+	assert.NoError(t, console.SaveState(&current))
+
+	other := newTestConsole(t, []byte{0xEA})
+	err := other.LoadState(bytes.NewReader(state.Bytes()))
+	assert.True(t, errors.Is(err, ErrStateMismatch))
+
+	err = console.LoadState(bytes.NewReader([]byte("NES\x1A")))
+	assert.True(t, errors.Is(err, ErrInvalidState))
+
+	data := append([]byte(nil), state.Bytes()...)
+	data[4] = stateVersion + 1
+	err = console.LoadState(bytes.NewReader(data))
+	assert.True(t, errors.Is(err, ErrStateVersion))
+
+	// A truncated state leaves the console untouched
+	err = console.LoadState(bytes.NewReader(state.Bytes()[:state.Len()-100]))
+	assert.True(t, errors.Is(err, ErrInvalidState))
+	var after bytes.Buffer
+	assert.NoError(t, console.SaveState(&after))
+	assert.Equal(t, current.Bytes(), after.Bytes())
+}
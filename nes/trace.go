@@ -0,0 +1,130 @@
+package nes
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// traceNames are the unofficial mnemonics Nintendulator spells differently
+// from the lookup table.
+var traceNames = map[string]string{
+	"ISC": "ISB",
+	"JAM": "KIL",
+}
+
+// tracer writes one line per instruction in the log format of Nintendulator,
+// which is also the format of nestest.log:
+//
+//	C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+//
+// Lines are written before the instruction runs, so memory values shown
+// after "=" are the ones it's about to read or overwrite.
+type tracer struct {
+	w io.Writer
+
+	// PPU position when the current system tick started, before the PPU
+	// was clocked for it
+	scanline int16
+	cycle    int16
+}
+
+func (t *tracer) instruction(c *CPU) {
+	scanline := t.scanline
+	if scanline < 0 {
+		scanline = 261
+	}
+	entry := &c.table[c.peek(c.pc)]
+	marker := ' '
+	if entry.illegal {
+		marker = '*'
+	}
+	bytes, text := c.traceInstruction(c.pc)
+	// Write errors only lose trace lines, they don't affect emulation
+	_, _ = fmt.Fprintf(t.w, "%04X  %-8s %c%-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d\n",
+		c.pc, bytes, marker, text, c.accumulator, c.xRegister, c.yRegister, c.status, c.stkp,
+		scanline, t.cycle, c.cycleCount)
+}
+
+// peek reads memory without side effects on the registers behind it.
+func (c *CPU) peek(addr uint16) uint8 {
+	return c.bus.cpuRead(addr, true)
+}
+
+func (c *CPU) peek16(lo uint16, hi uint16) uint16 {
+	return uint16(c.peek(hi))<<8 | uint16(c.peek(lo))
+}
+
+// traceInstruction returns the raw bytes and the disassembly of the
+// instruction at pc, with its operand resolved against the current
+// registers the way Nintendulator shows it.
+func (c *CPU) traceInstruction(pc uint16) (string, string) {
+	opcode := c.peek(pc)
+	entry := &c.table[opcode]
+	name := entry.name
+	if alias, ok := traceNames[name]; ok {
+		name = alias
+	}
+
+	length := 1
+	switch entry.mode {
+	case modeIMM, modeZP0, modeZPX, modeZPY, modeREL, modeIZX, modeIZY:
+		length = 2
+	case modeABS, modeABX, modeABY, modeIND:
+		length = 3
+	}
+	raw := make([]string, length)
+	for i := range raw {
+		raw[i] = fmt.Sprintf("%02X", c.peek(pc+uint16(i)))
+	}
+
+	lo := c.peek(pc + 1)
+	operand := uint16(c.peek(pc+2))<<8 | uint16(lo)
+	var text string
+	switch entry.mode {
+	case modeIMP:
+		text = name
+		switch name {
+		case "ASL", "LSR", "ROL", "ROR":
+			text += " A"
+		}
+	case modeIMM:
+		text = fmt.Sprintf("%s #$%02X", name, lo)
+	case modeZP0:
+		text = fmt.Sprintf("%s $%02X = %02X", name, lo, c.peek(uint16(lo)))
+	case modeZPX:
+		addr := lo + c.xRegister
+		text = fmt.Sprintf("%s $%02X,X @ %02X = %02X", name, lo, addr, c.peek(uint16(addr)))
+	case modeZPY:
+		addr := lo + c.yRegister
+		text = fmt.Sprintf("%s $%02X,Y @ %02X = %02X", name, lo, addr, c.peek(uint16(addr)))
+	case modeREL:
+		target := pc + 2 + uint16(int8(lo))
+		text = fmt.Sprintf("%s $%04X", name, target)
+	case modeABS:
+		if name == "JMP" || name == "JSR" {
+			text = fmt.Sprintf("%s $%04X", name, operand)
+		} else {
+			text = fmt.Sprintf("%s $%04X = %02X", name, operand, c.peek(operand))
+		}
+	case modeABX:
+		addr := operand + uint16(c.xRegister)
+		text = fmt.Sprintf("%s $%04X,X @ %04X = %02X", name, operand, addr, c.peek(addr))
+	case modeABY:
+		addr := operand + uint16(c.yRegister)
+		text = fmt.Sprintf("%s $%04X,Y @ %04X = %02X", name, operand, addr, c.peek(addr))
+	case modeIND:
+		// The pointer's high byte doesn't carry into the next page
+		target := c.peek16(operand, (operand&0xFF00)|uint16(uint8(operand)+1))
+		text = fmt.Sprintf("%s ($%04X) = %04X", name, operand, target)
+	case modeIZX:
+		ptr := lo + c.xRegister
+		addr := c.peek16(uint16(ptr), uint16(ptr+1))
+		text = fmt.Sprintf("%s ($%02X,X) @ %02X = %04X = %02X", name, lo, ptr, addr, c.peek(addr))
+	case modeIZY:
+		base := c.peek16(uint16(lo), uint16(lo+1))
+		addr := base + uint16(c.yRegister)
+		text = fmt.Sprintf("%s ($%02X),Y = %04X @ %04X = %02X", name, lo, base, addr, c.peek(addr))
+	}
+	return strings.Join(raw, " "), text
+}
@@ -0,0 +1,40 @@
+package nes
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	console := newTestConsole(t, []byte{
+		0xA9, 0x10, // LDA #$10
+		0x85, 0x00, // STA $00
+		0x04, 0x00, // NOP $00
+		0xB5, 0xFF, // LDA $FF,X
+		0x4A,             // LSR A
+		0x6C, 0xFF, 0x02, // JMP ($02FF)
+	})
+	console.bus.cpuWrite(0x02FF, 0x34)
+	console.bus.cpuWrite(0x0200, 0x12)
+	console.cpu.xRegister = 1
+
+	var trace bytes.Buffer
+	console.SetTrace(&trace)
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, console.StepInstruction())
+	}
+	console.SetTrace(nil)
+	assert.NoError(t, console.StepInstruction())
+
+	lines := strings.Split(strings.TrimSuffix(trace.String(), "\n"), "\n")
+	assert.Equal(t, []string{
+		"C000  A9 10     LDA #$10                        A:00 X:01 Y:00 P:24 SP:FD PPU:  0,  0 CYC:7",
+		"C002  85 00     STA $00 = 00                    A:10 X:01 Y:00 P:24 SP:FD PPU:  0,  6 CYC:9",
+		"C004  04 00    *NOP $00 = 10                    A:10 X:01 Y:00 P:24 SP:FD PPU:  0, 15 CYC:12",
+		"C006  B5 FF     LDA $FF,X @ 00 = 10             A:10 X:01 Y:00 P:24 SP:FD PPU:  0, 24 CYC:15",
+		"C008  4A        LSR A                           A:10 X:01 Y:00 P:24 SP:FD PPU:  0, 36 CYC:19",
+		"C009  6C FF 02  JMP ($02FF) = 1234              A:08 X:01 Y:00 P:24 SP:FD PPU:  0, 42 CYC:21",
+	}, lines)
+}
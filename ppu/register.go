@@ -25,6 +25,9 @@ func (r *Register) SetField(key string, value uint16) {
 
 func (r *Register) SetReg(value uint16) {
 	r.Reg = value
+	if r.values == nil {
+		r.values = make(map[string]uint16)
+	}
 	for key := range r.fields {
 		internalField := r.fields[key]
 		mask := uint16(((^(0xFFFF << internalField.Size) & 0xFF) << internalField.Index) & 0xFFFF)